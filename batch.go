@@ -2,6 +2,7 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/index"
 	"encoding/binary"
 	"sync"
 	"sync/atomic"
@@ -10,6 +11,9 @@ import (
 // 非事务seqNo
 const nonTransactionSeqNo uint64 = 0
 
+// 持久化的索引每次预留的事务序列号数量
+const seqNoReserveStep uint64 = 1000
+
 var txnFinKey = []byte("txn-fin")
 
 // WriteBatch 原子批量写数据，保证原子写
@@ -21,9 +25,6 @@ type WriteBatch struct {
 }
 
 func (db *DB) NewWriteBatch(options WriteBatchOptions) *WriteBatch {
-	if db.options.IndexType == BPlusTree && db.seqNoFileExists && !db.isInitial {
-		panic("cannot use write batch, seq no file not exists")
-	}
 	return &WriteBatch{
 		options:       options,
 		mu:            new(sync.Mutex),
@@ -59,7 +60,9 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	defer wb.mu.Unlock()
 
 	// 数据不存在则直接返回
+	wb.db.mu.RLock()
 	logRecordPos := wb.db.index.Get(key)
+	wb.db.mu.RUnlock()
 	if logRecordPos == nil {
 		if wb.pendingWrites[string(key)] != nil {
 			delete(wb.pendingWrites, string(key))
@@ -93,8 +96,40 @@ func (wb *WriteBatch) Commit() error {
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
 
+	// 新的 key 会增加索引的内存占用，检查是否超过了限制
+	if wb.db.options.MaxIndexMemory > 0 {
+		var newMemory int64
+		for _, record := range wb.pendingWrites {
+			if record.Type == data.LogRecordNormal && wb.db.index.Get(record.Key) == nil {
+				newMemory += index.EntryMemory(wb.db.index, len(record.Key))
+			}
+		}
+		if newMemory > 0 {
+			if err := wb.db.checkIndexMemory(newMemory); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 包含新写入数据的批次需要检查磁盘配额，只有删除的批次不受限制，可以用来回收空间
+	var batchSize int64
+	var hasNormal bool
+	for _, record := range wb.pendingWrites {
+		batchSize += record.MaxEncodedSize() + binary.MaxVarintLen64
+		hasNormal = hasNormal || record.Type == data.LogRecordNormal
+	}
+	if hasNormal {
+		if err := wb.db.checkDiskQuota(batchSize); err != nil {
+			return err
+		}
+	}
+
 	// 获取当前最新的事务序列号
 	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	if err := wb.db.reserveSeqNo(seqNo); err != nil {
+		atomic.AddUint64(&wb.db.seqNo, ^uint64(0))
+		return err
+	}
 
 	// 开始写数据到数据文件中
 	positions := make(map[string]*data.LogRecordPos)
@@ -122,21 +157,26 @@ func (wb *WriteBatch) Commit() error {
 
 	// 根据配置决定是否持久化
 	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+		if err := wb.db.syncActiveFile(); err != nil {
 			return err
 		}
 	}
 
-	// 更新内存索引
+	// 批量更新索引，持久化的索引只需要一次提交
+	entries := make([]*index.BatchEntry, 0, len(wb.pendingWrites))
 	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
-		var oldPos *data.LogRecordPos
-		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
-		}
+		entries = append(entries, &index.BatchEntry{
+			Key:    record.Key,
+			Pos:    positions[string(record.Key)],
+			Delete: record.Type == data.LogRecordDeleted,
+		})
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			atomic.AddUint64(&wb.db.metrics.deletes, 1)
+		} else {
+			atomic.AddUint64(&wb.db.metrics.puts, 1)
 		}
+	}
+	for _, oldPos := range wb.db.index.ApplyBatch(entries) {
 		if oldPos != nil {
 			wb.db.reclaimSize += int64(oldPos.Size)
 		}
@@ -148,6 +188,22 @@ func (wb *WriteBatch) Commit() error {
 	return nil
 }
 
+// 预留事务序列号，持久化的索引中保存预留的上限，重启之后从上限之后开始分配
+// 保证崩溃之后不会重复使用已经写入数据文件的序列号，否则重放时未完成的事务数据会被当作新事务的一部分
+// 在访问此方法时必须持有互斥锁
+func (db *DB) reserveSeqNo(seqNo uint64) error {
+	store, ok := db.index.(index.SeqNoStore)
+	if !ok || seqNo <= db.seqNoReserved {
+		return nil
+	}
+	reserved := seqNo + seqNoReserveStep
+	if err := store.SaveSeqNo(reserved); err != nil {
+		return err
+	}
+	db.seqNoReserved = reserved
+	return nil
+}
+
 // key + seq Number编码
 func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	seq := make([]byte, binary.MaxVarintLen64)
@@ -1,9 +1,12 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
 	"bitcask-go/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"strconv"
 	"testing"
 )
 
@@ -115,3 +118,127 @@ func TestDB_WriteBatch3(t *testing.T) {
 	//err = wb.Commit()
 	//assert.Nil(t, err)
 }
+
+func TestDB_WriteBatch_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	wbOpts := DefaultWriteBatchOptions
+	wbOpts.MaxBatchNum = 20000
+	wb := db.NewWriteBatch(wbOpts)
+	for i := 0; i < 10000; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, db.index.Size())
+
+	wb2 := db.NewWriteBatch(wbOpts)
+	for i := 0; i < 5000; i++ {
+		err := wb2.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = wb2.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, 5000, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(5001))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+// 模拟崩溃：不经过 Close 保存 seq-no 文件，直接释放资源
+func crashDB(db *DB) {
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+	_ = db.index.Close()
+	_ = db.fileLock.Unlock()
+}
+
+func TestDB_WriteBatch_BPlusTree_Crash(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-bptree-crash")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+		err = wb.Commit()
+		assert.Nil(t, err)
+	}
+	seqNo := db.seqNo
+	crashDB(db)
+
+	// 重启之后事务序列号不会回退，WriteBatch 可以正常使用
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Greater(t, db2.seqNo, seqNo)
+	wb := db2.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(10), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(db2.ListKeys()))
+}
+
+// seq-no 文件中的序列号先保存到B+树索引中再删除，重建索引之后同样重新保存，崩溃之后序列号不会回退
+func TestDB_WriteBatch_BPlusTree_SeqNoStore(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-bptree-seq-no")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+
+	// seq-no 文件中的序列号大于索引中预留的上限
+	var seqNo uint64 = 100000
+	seqNoFile, err := data.OpenSeqNoFile(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	_ = seqNoFile.IOManager.Truncate(0)
+	record, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(seqNoKey),
+		Value: []byte(strconv.FormatUint(seqNo, 10)),
+	})
+	assert.Nil(t, seqNoFile.Write(record))
+	assert.Nil(t, seqNoFile.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo, db.seqNo)
+	crashDB(db)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo, db.seqNo)
+
+	// 重建之后的索引文件中同样有序列号
+	assert.Nil(t, db.RebuildIndex())
+	crashDB(db)
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo, db.seqNo)
+}
@@ -17,43 +17,58 @@ const DataFileNameSuffix = ".data"
 const HintFileName = "hint-index"
 const MergeFinishedFileName = "merge-finished"
 const SeqNoFileName = "seq-no"
+const ManifestFileName = "MANIFEST"
+const ManifestTempFileName = ManifestFileName + ".tmp"
 
 type DataFile struct {
-	FileId    uint32        // 文件id
-	WriteOff  int64         // 文件写到了哪个位置
-	IOManager fio.IOManager // io读写管理
+	FileId    uint32         // 文件id
+	WriteOff  int64          // 文件写到了哪个位置
+	IOManager fio.IOManager  // io读写管理
+	fs        fio.FileSystem // 文件所在的文件系统
 }
 
 // OpenDataFile 打开新的数据文件
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func OpenDataFile(fs fio.FileSystem, dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	fileName := GetDataFileName(dirPath, fileId)
-	return newDataFile(fileName, fileId, ioType)
+	return newDataFile(fs, fileName, fileId, ioType)
 }
 
 // OpenHintFile 打开Hint索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fs, fileName, 0, fio.StandardFIO)
 }
 
 // OpenMergeFinishedFile 打开标识merge完成的文件
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
+func OpenMergeFinishedFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fs, fileName, 0, fio.StandardFIO)
 }
 
 // OpenSeqNoFile 存储事务序列号的文件
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
+func OpenSeqNoFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, SeqNoFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fs, fileName, 0, fio.StandardFIO)
+}
+
+// OpenManifestFile 打开记录数据目录元信息的文件
+func OpenManifestFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, ManifestFileName)
+	return newDataFile(fs, fileName, 0, fio.StandardFIO)
+}
+
+// OpenManifestTempFile 打开用于原子替换 MANIFEST 的临时文件
+func OpenManifestTempFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, ManifestTempFileName)
+	return newDataFile(fs, fileName, 0, fio.StandardFIO)
 }
 
 func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
-func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
-	ioManager, err := fio.NewIOManager(fileName, ioType)
+func newDataFile(fs fio.FileSystem, fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	ioManager, err := fs.OpenFile(fileName, ioType)
 	if err != nil {
 		return nil, err
 	}
@@ -61,10 +76,38 @@ func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFi
 		FileId:    fileId,
 		WriteOff:  0,
 		IOManager: ioManager,
+		fs:        fs,
 	}, nil
 }
 
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
+	logRecord, size, err := df.readLogRecord(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return logRecord, size, nil
+}
+
+// ReadTailLogRecord 读取活跃文件中的数据，末尾写了一半的数据被当作文件的末尾
+// 预分配、mmap 写入和 DirectIO 的补齐都会在文件末尾留下全为 0 的空间，崩溃时写了一半的数据之后全是 0，
+// 长度超出文件的数据读取时已经返回 io.EOF，校验失败时如果这条数据之后的内容全部为 0，同样返回 io.EOF
+func (df *DataFile) ReadTailLogRecord(offset int64) (*LogRecord, int64, error) {
+	logRecord, size, err := df.readLogRecord(offset)
+	if err != ErrInvalidCRC {
+		return logRecord, size, err
+	}
+	zero, zeroErr := df.isZeroFrom(offset + size)
+	if zeroErr != nil {
+		return nil, 0, zeroErr
+	}
+	if zero {
+		return nil, 0, io.EOF
+	}
+	return nil, 0, err
+}
+
+// 读取一条数据，校验失败时同样返回数据的长度
+func (df *DataFile) readLogRecord(offset int64) (*LogRecord, int64, error) {
 	fileSize, err := df.IOManager.Size()
 	if err != nil {
 		return nil, 0, err
@@ -83,6 +126,7 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	}
 
 	// 下面两个条件表示读取到了文件的末尾，直接返回EOF错误
+	// 预分配或者崩溃残留的空间全部为 0，有效的数据 key 不会为空，header 全为 0 同样表示末尾
 	header, headerSize := decodeLogRecordHeader(headerBuf)
 	if header == nil {
 		return nil, 0, io.EOF
@@ -110,7 +154,7 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 校验数据的crc是否正确
 	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
 	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+		return nil, recordSize, ErrInvalidCRC
 	}
 
 	return logRecord, recordSize, nil
@@ -119,6 +163,12 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.IOManager.Write(buf)
 	if err != nil {
+		// 丢弃可能已经写入了一部分的数据，否则之后的数据会追加在残缺的数据之后，和 WriteOff 对应不上
+		if n > 0 {
+			if truncErr := df.IOManager.Truncate(df.WriteOff); truncErr != nil {
+				return fmt.Errorf("%w, and failed to discard the partial write: %v", err, truncErr)
+			}
+		}
 		return err
 	}
 	// 更新 WriteOff
@@ -140,15 +190,27 @@ func (df *DataFile) Sync() error {
 	return df.IOManager.Sync()
 }
 
+// Close 关闭文件，关闭之后可以通过 SetIOManager 重新打开
 func (df *DataFile) Close() error {
-	return df.IOManager.Close()
+	if df.IOManager == nil {
+		return nil
+	}
+	err := df.IOManager.Close()
+	df.IOManager = nil
+	return err
 }
 
+// IsOpen 文件是否处于打开状态
+func (df *DataFile) IsOpen() bool {
+	return df.IOManager != nil
+}
+
+// SetIOManager 使用指定的 IO 类型重新打开文件
 func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
-	if err := df.IOManager.Close(); err != nil {
+	if err := df.Close(); err != nil {
 		return err
 	}
-	manager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType)
+	manager, err := df.fs.OpenFile(GetDataFileName(dirPath, df.FileId), ioType)
 	if err != nil {
 		return err
 	}
@@ -156,6 +218,31 @@ func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
 	return nil
 }
 
+// 判断从 offset 开始到文件末尾的内容是否全部为 0
+func (df *DataFile) isZeroFrom(offset int64) (bool, error) {
+	fileSize, err := df.IOManager.Size()
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, 64*1024)
+	for offset < fileSize {
+		n := int64(len(buf))
+		if offset+n > fileSize {
+			n = fileSize - offset
+		}
+		if _, err := df.IOManager.Read(buf[:n], offset); err != nil && err != io.EOF {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		offset += n
+	}
+	return true, nil
+}
+
 func (df *DataFile) readNBytes(n int64, offset int64) (b []byte, err error) {
 	b = make([]byte, n)
 	_, err = df.IOManager.Read(b, offset)
@@ -3,26 +3,27 @@ package data
 import (
 	"bitcask-go/fio"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
 	"testing"
 )
 
 func TestOpenDataFile(t *testing.T) {
-	dataFile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile1, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
-	dataFile2, err := OpenDataFile(os.TempDir(), 111, fio.StandardFIO)
+	dataFile2, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 111, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile2)
 
-	dataFile3, err := OpenDataFile(os.TempDir(), 111, fio.StandardFIO)
+	dataFile3, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 111, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile3)
 }
 
 func TestDataFile_Write(t *testing.T) {
-	dataFile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile1, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
@@ -37,7 +38,7 @@ func TestDataFile_Write(t *testing.T) {
 }
 
 func TestDataFile_Close(t *testing.T) {
-	dataFile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile1, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
@@ -46,7 +47,7 @@ func TestDataFile_Close(t *testing.T) {
 }
 
 func TestDataFile_Sync(t *testing.T) {
-	dataFile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile1, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
@@ -55,7 +56,7 @@ func TestDataFile_Sync(t *testing.T) {
 }
 
 func TestDataFile_ReadLogRecord(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 444, fio.StandardFIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 444, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -105,3 +106,59 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, size3, readSize3)
 
 }
+
+func TestDataFile_ReadLogRecordZeroTail(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-zero-tail")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(fio.OSFileSystem, dir, 1, fio.StandardFIO)
+	assert.Nil(t, err)
+	record, size := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")})
+	assert.Nil(t, dataFile.Write(record))
+	// 模拟预分配之后崩溃，文件尾部残留全为 0 的空间
+	assert.Nil(t, dataFile.Write(make([]byte, 4096)))
+	assert.Nil(t, dataFile.Close())
+
+	for _, ioType := range []fio.FileIOType{fio.StandardFIO, fio.MemoryMap} {
+		dataFile, err := OpenDataFile(fio.OSFileSystem, dir, 1, ioType)
+		assert.Nil(t, err)
+		_, readSize, err := dataFile.ReadLogRecord(0)
+		assert.Nil(t, err)
+		assert.Equal(t, size, readSize)
+		_, _, err = dataFile.ReadLogRecord(size)
+		assert.Equal(t, io.EOF, err)
+		_, _, err = dataFile.ReadLogRecord(size + 4096 - 3)
+		assert.Equal(t, io.EOF, err)
+		assert.Nil(t, dataFile.Close())
+	}
+}
+
+func TestDataFile_ReadTailLogRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-torn-tail")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(fio.OSFileSystem, dir, 1, fio.StandardFIO)
+	assert.Nil(t, err)
+	record, size := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")})
+	assert.Nil(t, dataFile.Write(record))
+	// 写了一半的数据，之后是预分配残留的 0
+	torn, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("a new value")})
+	assert.Nil(t, dataFile.Write(torn[:len(torn)/2]))
+	assert.Nil(t, dataFile.Write(make([]byte, 4096)))
+
+	_, readSize, err := dataFile.ReadTailLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+	_, _, err = dataFile.ReadLogRecord(size)
+	assert.Equal(t, ErrInvalidCRC, err)
+	_, _, err = dataFile.ReadTailLogRecord(size)
+	assert.Equal(t, io.EOF, err)
+
+	// 之后还有其他数据，不是末尾
+	assert.Nil(t, dataFile.Write(record))
+	_, _, err = dataFile.ReadTailLogRecord(size)
+	assert.Equal(t, ErrInvalidCRC, err)
+	assert.Nil(t, dataFile.Close())
+}
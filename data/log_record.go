@@ -84,6 +84,11 @@ func EncodeLogRecord(record *LogRecord) ([]byte, int64) {
 	return encBytes, int64(size)
 }
 
+// MaxEncodedSize 编码之后的最大长度，header 按照最大长度计算
+func (lr *LogRecord) MaxEncodedSize() int64 {
+	return int64(maxLOgRecordHeaderSize + len(lr.Key) + len(lr.Value))
+}
+
 // EncodeLogRecordPos 对位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
 	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64)
@@ -122,13 +127,19 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 		recordType: buf[4],
 	}
 	var index = 5
-	// 取出实际的 key size
+	// 取出实际的 key size，长度不完整说明 header 只写入了一部分
 	keySize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 
 	// 取出实际的value size
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
 
@@ -4,10 +4,9 @@ import (
 	"bitcask-go/data"
 	"bitcask-go/fio"
 	"bitcask-go/index"
-	"bitcask-go/utils"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/gofrs/flock"
 	"io"
 	"os"
 	"path/filepath"
@@ -15,6 +14,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -24,56 +25,90 @@ const (
 
 // DB bitcask 存储引擎实例
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     // 文件id, 只能在加载索引的时候使用，不能在其他的地方更新和使用
-	activeFile      *data.DataFile            // 当前活跃数据文件
-	olderFiles      map[uint32]*data.DataFile // 旧的数据文件，只能用于读取
-	index           index.Indexer             // 内存索引
-	seqNo           uint64                    // 事务序列号，全局递增
-	isMerging       bool                      // 是否正在merge
-	seqNoFileExists bool                      //存储事务序列号的文件是否存在
-	isInitial       bool                      // 是否是第一次初始化此数据目录
-	fileLock        *flock.Flock              // 文件锁保证多进程之间的互斥
-	bytesWrite      uint                      // 累计写了多少个字节
-	reclaimSize     int64                     // 表示有多少数据是无效的
+	options       Options
+	mu            *sync.RWMutex
+	fileIds       []int                     // 文件id, 只能在加载索引的时候使用，不能在其他的地方更新和使用
+	activeFile    *data.DataFile            // 当前活跃数据文件
+	olderFiles    map[uint32]*data.DataFile // 旧的数据文件，只能用于读取
+	index         index.Indexer             // 内存索引
+	seqNo         uint64                    // 事务序列号，全局递增
+	isMerging     bool                      // 是否正在merge
+	seqNoReserved uint64                    // 持久化的索引中已经预留的事务序列号上限
+	isInitial     bool                      // 是否是第一次初始化此数据目录
+	fs            fio.FileSystem            // 数据目录所在的文件系统
+	fileLock      fio.FileLock              // 文件锁保证多进程之间的互斥
+	bytesWrite    uint                      // 累计写了多少个字节
+	reclaimSize   int64                     // 表示有多少数据是无效的
+	metrics       *metrics                  // 运行指标统计
+	listener      EventListener             // 内部事件监听器
+	directIO      bool                      // 活跃文件是否使用 O_DIRECT 写入，仅用于 merge 的临时实例
+	valueCache    *valueCache               // Get 使用的 value 缓存，为空表示不使用缓存
+	fileCache     *fileCache                // 限制打开的旧数据文件数量，为空表示不限制
+	diskUsage     int64                     // 数据目录占用磁盘空间的估算值，只在设置了磁盘配额时统计
+	diskAvailable int64                     // 磁盘剩余空间的估算值，只在设置了磁盘配额时统计
+	syncedFileId  uint32                    // 最近一次持久化的活跃文件id
+	syncedOffset  int64                     // 最近一次持久化时活跃文件写入的位置
+	closeCh       chan struct{}             // 关闭时通知后台任务退出
+	closeOnce     *sync.Once                // 保证后台任务只会被停止一次
+	background    *sync.WaitGroup           // 运行中的后台任务
 }
 
 // Stat 存储引擎统计信息
 type Stat struct {
-	KeyNum          uint  // key 的总数量
-	DataFileNum     uint  // 数据文件的数量
-	ReclaimableSize int64 //可以进行merge回收的数据量，字节为单位
-	DiskSize        int64 // 数据目录所占磁盘空间的大小
+	KeyNum          uint   // key 的总数量
+	DataFileNum     uint   // 数据文件的数量
+	ReclaimableSize int64  //可以进行merge回收的数据量，字节为单位
+	DiskSize        int64  // 数据目录所占磁盘空间的大小
+	IndexMemory     int64  // 索引占用内存的估算值，字节为单位
+	CacheHits       uint64 // value 缓存命中的次数
+	CacheMisses     uint64 // value 缓存未命中的次数
+	SyncedFileId    uint32 // 最近一次持久化的活跃文件id
+	SyncedOffset    int64  // 最近一次持久化的位置，此位置之前的数据已经持久化到磁盘中
 }
 
 // Open 打开bitcask存储引擎实例
-func Open(options Options) (*DB, error) {
+func Open(options Options) (_ *DB, err error) {
 	// 对用户传入的配置项进行校验
 	if err := checkOptions(options); err != nil {
 		return nil, err
 	}
 
+	// 确定使用的文件系统，merge 时打开的临时实例也使用同一个文件系统
+	fs := options.fileSystem()
+	options.FileSystem = fs
+
 	var isInitial bool
 	// 判断数据目录是否存在，如果不存在的话，则创建这个目录
-	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
+	if _, err := fs.Stat(options.DirPath); os.IsNotExist(err) {
 		isInitial = true
-		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		if err := fs.MkdirAll(options.DirPath); err != nil {
+			return nil, err
+		}
+		if err := fs.SyncDir(filepath.Dir(filepath.Clean(options.DirPath))); err != nil {
 			return nil, err
 		}
 	}
 
 	// 判断当前数据目录是否正在使用
-	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
+	fileLock, hold, err := fs.TryLock(filepath.Join(options.DirPath, fileLockName))
 	if err != nil {
 		return nil, err
 	}
 	if !hold {
 		return nil, ErrDatabaseIsUsing
 	}
+	// 打开失败时关闭已经打开的文件和索引，并释放文件锁
+	var db *DB
+	defer func() {
+		if err != nil {
+			if db != nil {
+				db.closeFiles()
+			}
+			_ = fileLock.Unlock()
+		}
+	}()
 
-	entries, err := os.ReadDir(options.DirPath)
+	entries, err := fs.ReadDir(options.DirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -81,18 +116,57 @@ func Open(options Options) (*DB, error) {
 		isInitial = true
 	}
 
+	// 校验数据目录的 MANIFEST，需要在创建索引之前进行，避免用错误的索引类型打开数据目录
+	dirManifest, err := readManifest(fs, options.DirPath)
+	if err == nil {
+		if dirManifest != nil {
+			err = checkManifest(dirManifest, options)
+		} else {
+			err = checkLegacyDirectory(options)
+		}
+	}
+	// 允许转换索引类型时，按照新的索引类型重新构建索引
+	convertIndex := false
+	if errors.Is(err, ErrIndexTypeMismatch) && options.AllowIndexConversion {
+		convertIndex, err = true, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	// 初始化 DB 实例结构体
-	db := &DB{
+	db = &DB{
 		options:    options,
 		mu:         new(sync.RWMutex),
 		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
 		isInitial:  isInitial,
+		fs:         fs,
 		fileLock:   fileLock,
+		metrics:    newMetrics(),
+		listener:   options.EventListener,
+		closeCh:    make(chan struct{}),
+		closeOnce:  new(sync.Once),
+		background: new(sync.WaitGroup),
+	}
+	if db.listener == nil {
+		db.listener = BaseEventListener{}
+	}
+	if options.ValueCacheSize > 0 {
+		db.valueCache = newValueCache(options.ValueCacheSize)
+	}
+	if options.MaxOpenFiles > 0 {
+		db.fileCache = newFileCache(options.DirPath, options.MaxOpenFiles)
 	}
 
 	// 加载 merge 数据目录
-	if err := db.loadMergeFiles(); err != nil {
+	mergeInstalled, err := db.loadMergeFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建索引，需要在 merge 数据目录加载完成之后，merge 会使持久化的索引失效
+	rebuildIndex, err := db.openIndex(convertIndex || mergeInstalled)
+	if err != nil {
 		return nil, err
 	}
 
@@ -101,8 +175,15 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
-	// B+树索引不需要从数据文件加载索引
-	if options.IndexType != BPlusTree {
+	// 校验 MANIFEST 中记录的数据文件
+	if dirManifest != nil {
+		if err := db.checkManifestFiles(dirManifest); err != nil {
+			return nil, err
+		}
+	}
+
+	// 持久化的索引不需要从数据文件加载索引，除非磁盘上的索引需要重建
+	if rebuildIndex {
 		// 从hint索引文件中加载索引
 		if err := db.loadIndexFromHintFile(); err != nil {
 			return nil, err
@@ -113,33 +194,89 @@ func Open(options Options) (*DB, error) {
 			return nil, err
 		}
 
-		// 重置 IO 类型为标准文件IO
-		if db.options.MMapAtStartup {
-			if err := db.resetIoType(); err != nil {
-				return nil, err
-			}
+		// 索引加载完成之后才替换磁盘上的索引文件
+		if err := db.installRebuiltIndex(); err != nil {
+			return nil, err
 		}
 	}
 
-	// 取出当前事务序列号
-	if options.IndexType == BPlusTree {
+	// 重置 IO 类型为标准文件IO，活跃文件使用配置的IO类型
+	if db.options.MMapAtStartup || db.options.MMapWrites {
+		if err := db.resetIoType(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 持久化的索引没有重放数据文件，从索引中取出当前事务序列号
+	if store, ok := db.index.(index.SeqNoStore); ok {
+		if err := db.loadSeqNoFromStore(store); err != nil {
+			return nil, err
+		}
+	} else if !rebuildIndex {
 		if err := db.loadSeqNo(); err != nil {
 			return nil, err
 		}
-		if db.activeFile != nil {
-			size, err := db.activeFile.IOManager.Size()
-			if err != nil {
-				return nil, err
-			}
-			db.activeFile.WriteOff = size
+	}
+	// 截断活跃文件尾部无效的数据，例如 mmap 写入或者预分配之后崩溃残留的空间
+	if err := db.truncateActiveFile(!rebuildIndex); err != nil {
+		return nil, err
+	}
+	if err := db.preallocateActiveFile(); err != nil {
+		return nil, err
+	}
+	if err := db.bufferActiveFile(); err != nil {
+		return nil, err
+	}
+
+	// 从B+树索引转换为内存索引，磁盘上的索引文件不再需要
+	if convertIndex && options.IndexType != BPlusTree {
+		bptreeFileName := filepath.Join(options.DirPath, index.BPTreeIndexFileName)
+		if err := fs.Remove(bptreeFileName); err != nil && !os.IsNotExist(err) {
+			return nil, err
 		}
 	}
 
+	// 写入当前的 MANIFEST，没有 MANIFEST 的旧数据目录在这里完成升级
+	if err := db.writeManifest(); err != nil {
+		return nil, err
+	}
+
+	// 统计当前的磁盘占用，用于检查磁盘配额
+	if err := db.refreshDiskUsage(); err != nil {
+		return nil, err
+	}
+
+	// 定时将写缓冲区中的数据写入文件
+	if options.WriteBufferSize > 0 && options.WriteBufferFlushInterval > 0 {
+		db.background.Add(1)
+		go db.flushWriteBufferPeriodically(options.WriteBufferFlushInterval)
+	}
+	// 定时持久化活跃文件
+	if options.SyncInterval > 0 {
+		db.background.Add(1)
+		go db.syncPeriodically(options.SyncInterval)
+	}
+
 	return db, nil
 }
 
+// 关闭所有打开的数据文件和索引，用于 Open 失败时的清理
+func (db *DB) closeFiles() {
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, dataFile := range db.olderFiles {
+		_ = dataFile.Close()
+	}
+	if db.index != nil {
+		_ = db.index.Close()
+	}
+}
+
 // Close 关闭数据库
-func (db *DB) Close() error {
+func (db *DB) Close() (err error) {
+	// 先停止后台任务，后台任务需要获取锁
+	db.stopBackground()
 	defer func() {
 		// 释放文件锁
 		if err := db.fileLock.Unlock(); err != nil {
@@ -150,6 +287,13 @@ func (db *DB) Close() error {
 			panic(fmt.Sprintf("failed to close index"))
 		}
 	}()
+	defer func() {
+		info := CloseInfo{SeqNo: db.seqNo, Err: err}
+		if db.activeFile != nil {
+			info.ActiveFileId = db.activeFile.FileId
+		}
+		db.listener.OnClose(info)
+	}()
 	if db.activeFile == nil {
 		return nil
 	}
@@ -157,7 +301,7 @@ func (db *DB) Close() error {
 	defer db.mu.Unlock()
 
 	// 保存当前的事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
+	seqNoFile, err := data.OpenSeqNoFile(db.fs, db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -172,6 +316,9 @@ func (db *DB) Close() error {
 	if err := seqNoFile.Sync(); err != nil {
 		return err
 	}
+	if err := db.fs.SyncDir(db.options.DirPath); err != nil {
+		return err
+	}
 
 	// 关闭当前活跃文件
 	err = db.activeFile.Close()
@@ -193,7 +340,28 @@ func (db *DB) Sync() error {
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	return db.syncActiveFile()
+}
+
+// 持久化当前活跃文件，并记录 fsync 的次数和延迟
+// 在访问此方法时必须持有互斥锁
+func (db *DB) syncActiveFile() error {
+	start := time.Now()
+	err := db.activeFile.Sync()
+	duration := time.Since(start)
+	db.listener.OnSync(SyncInfo{
+		FileId:   db.activeFile.FileId,
+		Offset:   db.activeFile.WriteOff,
+		Duration: duration,
+		Err:      err,
+	})
+	if err != nil {
+		return err
+	}
+	db.syncedFileId, db.syncedOffset = db.activeFile.FileId, db.activeFile.WriteOff
+	atomic.AddUint64(&db.metrics.syncs, 1)
+	db.metrics.syncLatency.observe(duration)
+	return nil
 }
 
 // Stat 返回数据库的相关统计信息
@@ -206,32 +374,80 @@ func (db *DB) Stat() *Stat {
 		dataFiles += 1
 	}
 
-	dirSize, err := utils.DirSize(db.options.DirPath)
+	dirSize, err := db.fs.DirSize(db.options.DirPath)
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size: %v", err))
 	}
-	return &Stat{
+	stat := &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize, // todo
+		IndexMemory:     db.index.MemoryUsage(),
+		SyncedFileId:    db.syncedFileId,
+		SyncedOffset:    db.syncedOffset,
+	}
+	if db.valueCache != nil {
+		stat.CacheHits = atomic.LoadUint64(&db.valueCache.hits)
+		stat.CacheMisses = atomic.LoadUint64(&db.valueCache.misses)
 	}
+	return stat
 }
 
 // Backup 备份数据
 func (db *DB) Backup(dir string) error {
+	return db.BackupContext(context.Background(), dir)
+}
+
+// BackupContext 备份数据，ctx 被取消时停止拷贝，并删除本次备份创建的目标目录
+func (db *DB) BackupContext(ctx context.Context, dir string) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+	start := time.Now()
+	// 写缓冲区中的数据需要先写入文件才能被拷贝
+	if err := db.flushWriteBuffer(); err != nil {
+		return err
+	}
+	_, statErr := db.fs.Stat(dir)
+	err := db.fs.CopyDir(ctx, db.options.DirPath, dir, []string{fileLockName, index.BPTreeRebuildFileName})
+	if err != nil && os.IsNotExist(statErr) {
+		// 目标目录是本次备份创建的，删除不完整的备份
+		_ = db.fs.RemoveAll(dir)
+	}
+	db.listener.OnBackupFinish(BackupInfo{
+		Dir:      dir,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	return err
 }
 
 // Put 写入 Key/Value 到数据文件
-func (db *DB) Put(key []byte, value []byte) error {
+func (db *DB) Put(key []byte, value []byte) (err error) {
 	// 判断key是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	// 只统计成功的写入
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			atomic.AddUint64(&db.metrics.puts, 1)
+			db.metrics.putLatency.observe(time.Since(start))
+		}
+	}()
+
+	// 索引可能被 RebuildIndex 替换，读取、写入数据和更新索引都需要持有锁
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 新的 key 会增加索引的内存占用，检查是否超过了限制
+	if db.options.MaxIndexMemory > 0 && db.index.Get(key) == nil {
+		if err := db.checkIndexMemory(index.EntryMemory(db.index, len(key))); err != nil {
+			return err
+		}
+	}
 
 	// 构造LogRecord结构体
 	logRecord := &data.LogRecord{
@@ -240,8 +456,13 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Type:  data.LogRecordNormal,
 	}
 
+	// 在写入数据文件之前检查磁盘配额，避免磁盘写满时留下不完整的数据
+	if err := db.checkDiskQuota(logRecord.MaxEncodedSize()); err != nil {
+		return err
+	}
+
 	// 追加写入到当前活跃数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
@@ -253,12 +474,32 @@ func (db *DB) Put(key []byte, value []byte) error {
 	return nil
 }
 
+// 检查索引的内存占用增加 size 字节之后是否会超过限制
+func (db *DB) checkIndexMemory(size int64) error {
+	if usage := db.index.MemoryUsage(); usage+size > db.options.MaxIndexMemory {
+		return fmt.Errorf("%w: estimated usage %d bytes, limit %d bytes",
+			ErrIndexMemoryExceeded, usage, db.options.MaxIndexMemory)
+	}
+	return nil
+}
+
 // Delete 根据Key删除对应的数据
-func (db *DB) Delete(key []byte) error {
+func (db *DB) Delete(key []byte) (err error) {
 	// 判断key是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	// 只统计成功的删除
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			atomic.AddUint64(&db.metrics.deletes, 1)
+			db.metrics.deleteLatency.observe(time.Since(start))
+		}
+	}()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
 	// 先检查key是否存在，若不存在则直接返回
 	if pos := db.index.Get(key); pos == nil {
@@ -271,7 +512,7 @@ func (db *DB) Delete(key []byte) error {
 		Type: data.LogRecordDeleted,
 	}
 	// 写到数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
@@ -295,38 +536,54 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
+	start := time.Now()
+	defer func() {
+		atomic.AddUint64(&db.metrics.gets, 1)
+		db.metrics.getLatency.observe(time.Since(start))
+	}()
 
 	// 从内存索引结构中取出key对应的索引信息
 	logRecordPos := db.index.Get(key)
 	if logRecordPos == nil {
+		atomic.AddUint64(&db.metrics.getMisses, 1)
 		return nil, ErrKeyNotFound
 	}
 
 	// 从数据文件中获取value
-	return db.getValueByPosition(logRecordPos)
+	return db.getCachedValue(logRecordPos)
 }
 
 // ListKeys 获取数据库中所有的key
 func (db *DB) ListKeys() [][]byte {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	// 迭代器是按批次遍历的，遍历过程中 key 的数量可能发生变化
+	keys := make([][]byte, 0, db.index.Size())
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
 
 // Fold 获取所有的数据，并执行用户指定的操作，函数返回false则终止遍历
 func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
+	return db.FoldContext(context.Background(), fn)
+}
+
+// FoldContext 获取所有的数据，并执行用户指定的操作，函数返回false或者 ctx 被取消则终止遍历
+func (db *DB) FoldContext(ctx context.Context, fn func(key []byte, value []byte) bool) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -338,6 +595,28 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	return nil
 }
 
+// 根据索引信息获取对应的value，优先从 value 缓存中查找，未命中时读取之后放入缓存
+// 只有 Get 使用缓存，迭代器和 Fold 的大范围遍历不会挤占热点数据
+func (db *DB) getCachedValue(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	if db.valueCache == nil {
+		return db.getValueByPosition(logRecordPos)
+	}
+	// 缓存和调用方各自持有一份数据，调用方修改返回值不会影响缓存
+	if cached, ok := db.valueCache.get(logRecordPos); ok {
+		value := make([]byte, len(cached))
+		copy(value, cached)
+		return value, nil
+	}
+	value, err := db.getValueByPosition(logRecordPos)
+	if err != nil {
+		return nil, err
+	}
+	cached := make([]byte, len(value))
+	copy(cached, value)
+	db.valueCache.add(logRecordPos, cached)
+	return value, nil
+}
+
 // 根据索引信息获取对应的value
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
 	// 根据文件 id 找到对应的数据文件
@@ -351,6 +630,11 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
+	release, err := db.acquireDataFile(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	// 根据偏移量读取对应的数据
 	record, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
@@ -365,12 +649,6 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 	return record.Value, nil
 }
 
-func (db *DB) appendLogRecordWithLock(record *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(record)
-}
-
 // 追加写数据到活跃文件中
 func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error) {
 
@@ -389,14 +667,11 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	// 如果写入数据已经达到了活跃文件的大小阈值，则关闭活跃文件，打开新的文件
 	if db.activeFile.WriteOff+size > db.options.DataFileSize {
 		// 先持久化数据文件，保证已有的数据持久化到磁盘中
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
 		// 当前活跃文件转化为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-		// 打开新的数据文件
-		if err := db.setActiveDataFile(); err != nil {
+		if err := db.rotateActiveDataFile(); err != nil {
 			return nil, err
 		}
 	}
@@ -407,13 +682,15 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	}
 
 	db.bytesWrite += uint(size)
+	atomic.AddUint64(&db.metrics.bytesWritten, uint64(size))
+	db.trackDiskUsage(size)
 	// 根据用户配置决定是否持久化
 	var needSync = db.options.SyncWrites
 	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
 		needSync = true
 	}
 	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
 		// 清空累计值
@@ -431,6 +708,48 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	return pos, nil
 }
 
+// 将当前活跃文件转化为旧的数据文件，并打开新的活跃文件
+// 在访问此方法时必须持有互斥锁
+func (db *DB) rotateActiveDataFile() error {
+	oldFile := db.activeFile
+	db.olderFiles[oldFile.FileId] = oldFile
+
+	// 旧的数据文件不再写入，去掉写缓冲
+	if err := unbufferDataFile(oldFile); err != nil {
+		return err
+	}
+	// 释放没有用到的预分配空间
+	if db.options.Preallocate {
+		if err := oldFile.IOManager.Truncate(oldFile.WriteOff); err != nil {
+			return err
+		}
+	}
+
+	// 写满的文件不再写入，转为标准文件IO，关闭映射时文件会截断为实际大小
+	if db.activeIOType() != fio.StandardFIO {
+		if err := oldFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+			return err
+		}
+	}
+	db.cacheDataFile(oldFile)
+
+	// 打开新的数据文件
+	if err := db.setActiveDataFile(); err != nil {
+		return err
+	}
+	// 重新统计磁盘占用，修正索引、hint 等其他文件带来的误差
+	if err := db.refreshDiskUsage(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&db.metrics.fileRotations, 1)
+	db.listener.OnFileRotated(FileRotationInfo{
+		OldFileId:   oldFile.FileId,
+		OldFileSize: oldFile.WriteOff,
+		NewFileId:   db.activeFile.FileId,
+	})
+	return nil
+}
+
 // 设置当前活跃文件
 // 在访问此方法时必须持有互斥锁
 func (db *DB) setActiveDataFile() error {
@@ -439,16 +758,28 @@ func (db *DB) setActiveDataFile() error {
 		initialFileId = db.activeFile.FileId + 1
 	}
 	// 打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, fio.StandardFIO)
+	dataFile, err := data.OpenDataFile(db.fs, db.options.DirPath, initialFileId, db.activeIOType())
 	if err != nil {
 		return err
 	}
+	// 持久化数据目录，否则掉电之后新的数据文件连同其中已经持久化的数据一起丢失
+	if err := db.fs.SyncDir(db.options.DirPath); err != nil {
+		_ = dataFile.Close()
+		return err
+	}
 	db.activeFile = dataFile
-	return nil
+	if err := db.preallocateActiveFile(); err != nil {
+		return err
+	}
+	if err := db.bufferActiveFile(); err != nil {
+		return err
+	}
+	// 数据文件集合发生了变化，更新 MANIFEST
+	return db.writeManifest()
 }
 
 func (db *DB) loadDatafiles() error {
-	dirEntries, err := os.ReadDir(db.options.DirPath)
+	dirEntries, err := db.fs.ReadDir(db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -478,7 +809,7 @@ func (db *DB) loadDatafiles() error {
 		if db.options.MMapAtStartup {
 			ioType = fio.MemoryMap
 		}
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType)
+		dataFile, err := data.OpenDataFile(db.fs, db.options.DirPath, uint32(fid), ioType)
 		if err != nil {
 			return err
 		}
@@ -486,8 +817,9 @@ func (db *DB) loadDatafiles() error {
 			// 最后一个，id是最大的，说明是当前的活跃文件
 			db.activeFile = dataFile
 		} else {
-			// 说明是旧的数据文件
+			// 说明是旧的数据文件，超过打开文件数量的限制时会被关闭
 			db.olderFiles[uint32(fid)] = dataFile
+			db.cacheDataFile(dataFile)
 		}
 	}
 	return nil
@@ -502,7 +834,7 @@ func (db *DB) loadIndexFromDatafiles() error {
 	// 查找是否发生过merge
 	hasMerge, nonMergeFileId := false, uint32(0)
 	mergedFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergedFinFileName); err == nil {
+	if _, err := db.fs.Stat(mergedFinFileName); err == nil {
 		fid, err := db.getNonMergeFileId(db.options.DirPath)
 		if err != nil {
 			return err
@@ -511,19 +843,15 @@ func (db *DB) loadIndexFromDatafiles() error {
 		nonMergeFileId = fid
 	}
 
+	loader := db.newIndexLoader()
 	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.index.Put(key, pos)
-		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
-		}
+		loader.add(key, typ == data.LogRecordDeleted, pos)
 	}
 
+	start := time.Now()
+	var records int
+	var replayedFileIds []uint32
+
 	// 暂存事务数据
 	transactionRecords := make(map[uint64][]*data.TransactionRecord)
 	var currentSeqNo = nonTransactionSeqNo
@@ -541,14 +869,25 @@ func (db *DB) loadIndexFromDatafiles() error {
 		} else {
 			dataFile = db.olderFiles[fileId]
 		}
+		replayedFileIds = append(replayedFileIds, fileId)
+		release, err := db.acquireDataFile(dataFile)
+		if err != nil {
+			return err
+		}
 
+		// 活跃文件末尾可能有崩溃时写了一半的数据
+		readLogRecord := dataFile.ReadLogRecord
+		if dataFile == db.activeFile {
+			readLogRecord = dataFile.ReadTailLogRecord
+		}
 		var offset int64 = 0
 		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			logRecord, size, err := readLogRecord(offset)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
+				release()
 				return err
 			}
 
@@ -586,7 +925,9 @@ func (db *DB) loadIndexFromDatafiles() error {
 
 			// 递增offset，下一次从新的位置开始读取
 			offset += size
+			records++
 		}
+		release()
 
 		// 如果是当前的活跃文件，更新这个文件的 WriteOff
 		if i == len(db.fileIds)-1 {
@@ -594,11 +935,62 @@ func (db *DB) loadIndexFromDatafiles() error {
 		}
 	}
 
+	loader.flush()
+
 	// 更新事务序列号
-	db.seqNo = currentSeqNo
+	if currentSeqNo > db.seqNo {
+		db.seqNo = currentSeqNo
+	}
+	db.listener.OnRecovery(RecoveryInfo{
+		Action:   RecoveryDataFilesReplayed,
+		FileIds:  replayedFileIds,
+		Records:  records,
+		Duration: time.Since(start),
+	})
 	return nil
 }
 
+// 加载索引时每个批次的数据条数
+const indexLoadBatchSize = 1024
+
+// indexLoader 加载索引时暂存待更新的数据，攒够一个批次之后批量更新索引
+type indexLoader struct {
+	db      *DB
+	entries []*index.BatchEntry
+}
+
+func (db *DB) newIndexLoader() *indexLoader {
+	return &indexLoader{
+		db:      db,
+		entries: make([]*index.BatchEntry, 0, indexLoadBatchSize),
+	}
+}
+
+func (l *indexLoader) add(key []byte, deleted bool, pos *data.LogRecordPos) {
+	l.entries = append(l.entries, &index.BatchEntry{Key: key, Pos: pos, Delete: deleted})
+	if len(l.entries) >= indexLoadBatchSize {
+		l.flush()
+	}
+}
+
+// 批量更新索引，并累计无效数据的大小
+func (l *indexLoader) flush() {
+	if len(l.entries) == 0 {
+		return
+	}
+	oldPositions := l.db.index.ApplyBatch(l.entries)
+	for i, entry := range l.entries {
+		// 删除的记录本身也是无效数据
+		if entry.Delete {
+			l.db.reclaimSize += int64(entry.Pos.Size)
+		}
+		if oldPositions[i] != nil {
+			l.db.reclaimSize += int64(oldPositions[i].Size)
+		}
+	}
+	l.entries = l.entries[:0]
+}
+
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
 		return errors.New("database dir path is empty")
@@ -609,41 +1001,288 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if (options.IndexType == Custom) != (options.IndexerFactory != nil) {
+		return errors.New("custom index type must be used together with the indexer factory")
+	}
+	if options.MaxIndexMemory < 0 {
+		return errors.New("max index memory must not be negative")
+	}
+	if options.BloomFalsePositive < 0 || options.BloomFalsePositive >= 1 {
+		return errors.New("invalid bloom filter false positive rate, must between 0 and 1")
+	}
+	if options.InMemory && !options.inMemory() {
+		return errors.New("in memory database must use a memory file system")
+	}
+	if options.inMemory() && options.IndexType == BPlusTree {
+		return errors.New("b+ tree index is not supported in memory")
+	}
+	if options.ValueCacheSize < 0 {
+		return errors.New("value cache size must not be negative")
+	}
+	if options.MaxOpenFiles < 0 {
+		return errors.New("max open files must not be negative")
+	}
+	if options.MaxDiskSize < 0 || options.MinFreeDiskSpace < 0 {
+		return errors.New("disk quota must not be negative")
+	}
+	if options.SyncInterval < 0 {
+		return errors.New("sync interval must not be negative")
+	}
+	if options.WriteBufferSize < 0 || options.WriteBufferFlushInterval < 0 {
+		return errors.New("write buffer size and flush interval must not be negative")
+	}
 	return nil
 }
 
 func (db *DB) loadSeqNo() error {
+	seqNo, ok, err := db.readSeqNoFile()
+	if err != nil || !ok {
+		return err
+	}
+	db.seqNo = seqNo
+	return db.removeSeqNoFile()
+}
+
+// 读取 seq-no 文件中的事务序列号，文件不存在时返回 false
+func (db *DB) readSeqNoFile() (uint64, bool, error) {
 	fileName := filepath.Join(db.options.DirPath, data.SeqNoFileName)
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return nil
+	if _, err := db.fs.Stat(fileName); os.IsNotExist(err) {
+		return 0, false, nil
 	}
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
+	seqNoFile, err := data.OpenSeqNoFile(db.fs, db.options.DirPath)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
+	defer func() {
+		_ = seqNoFile.Close()
+	}()
 	record, _, err := seqNoFile.ReadLogRecord(0)
+	if err != nil {
+		return 0, false, err
+	}
 	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
 	if err != nil {
+		return 0, false, err
+	}
+	db.listener.OnRecovery(RecoveryInfo{Action: RecoverySeqNoLoaded, Records: 1})
+	return seqNo, true, nil
+}
+
+// 删除已经加载的 seq-no 文件
+func (db *DB) removeSeqNoFile() error {
+	// 删除之后需要持久化目录，否则掉电之后过期的序列号文件会重新出现
+	if err := db.fs.Remove(filepath.Join(db.options.DirPath, data.SeqNoFileName)); err != nil {
 		return err
 	}
-	db.seqNo = seqNo
-	db.seqNoFileExists = true
-	return os.Remove(fileName)
+	return db.fs.SyncDir(db.options.DirPath)
 }
 
-// 将数据文件的io类型设置为标准文件io
+// 从持久化的索引中取出事务序列号
+// 索引中保存的是预留的上限，重放的数据文件和旧版本的 seq-no 文件中也可能有序列号，取最大的
+func (db *DB) loadSeqNoFromStore(store index.SeqNoStore) error {
+	fileSeqNo, hasFile, err := db.readSeqNoFile()
+	if err != nil {
+		return err
+	}
+	storedSeqNo, err := store.LoadSeqNo()
+	if err != nil {
+		return err
+	}
+	for _, seqNo := range []uint64{fileSeqNo, storedSeqNo} {
+		if seqNo > db.seqNo {
+			db.seqNo = seqNo
+		}
+	}
+	// 先保存到索引中再删除 seq-no 文件，避免崩溃之后序列号丢失
+	if db.seqNo > storedSeqNo {
+		if err := store.SaveSeqNo(db.seqNo); err != nil {
+			return err
+		}
+	}
+	if hasFile {
+		if err := db.removeSeqNoFile(); err != nil {
+			return err
+		}
+	}
+	// 下一次提交时重新预留
+	db.seqNoReserved = db.seqNo
+	return nil
+}
+
+// 添加旧的数据文件到文件句柄缓存中，没有限制打开文件数量时不做处理
+func (db *DB) cacheDataFile(dataFile *data.DataFile) {
+	if db.fileCache != nil {
+		db.fileCache.add(dataFile)
+	}
+}
+
+// 获取数据文件的读取权，被关闭的旧数据文件会重新打开，读取完成之后需要调用返回的 release
+func (db *DB) acquireDataFile(dataFile *data.DataFile) (func(), error) {
+	if db.fileCache == nil {
+		return func() {}, nil
+	}
+	return db.fileCache.acquire(dataFile)
+}
+
+// 将旧数据文件的io类型设置为标准文件io，活跃文件设置为配置的io类型
 func (db *DB) resetIoType() error {
 	if db.activeFile == nil {
 		return nil
 	}
-	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+	if err := db.activeFile.SetIOManager(db.options.DirPath, db.activeIOType()); err != nil {
 		return err
 	}
+	if !db.options.MMapAtStartup {
+		return nil
+	}
 
 	for _, dataFile := range db.olderFiles {
+		// 超过打开文件数量的限制被关闭的文件，重新打开时使用标准文件IO
+		if !dataFile.IsOpen() {
+			continue
+		}
 		if err := dataFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// 活跃文件使用的io类型
+func (db *DB) activeIOType() fio.FileIOType {
+	if db.directIO {
+		return fio.DirectIO
+	}
+	if db.options.MMapWrites {
+		return fio.WritableMemoryMap
+	}
+	return fio.StandardFIO
+}
+
+// 将活跃文件截断到最后一条有效数据的末尾
+// scan 为 true 表示没有重放数据文件，需要扫描活跃文件找到写入位置
+func (db *DB) truncateActiveFile(scan bool) error {
+	if db.activeFile == nil {
+		return nil
+	}
+	if scan {
+		var offset int64
+		for {
+			_, size, err := db.activeFile.ReadTailLogRecord(offset)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			offset += size
+		}
+		db.activeFile.WriteOff = offset
+	}
+	size, err := db.activeFile.IOManager.Size()
+	if err != nil {
+		return err
+	}
+	if size > db.activeFile.WriteOff {
+		return db.activeFile.IOManager.Truncate(db.activeFile.WriteOff)
+	}
+	return nil
+}
+
+// 为活跃文件预分配 DataFileSize 大小的空间，需要在加上写缓冲之前进行
+// 可写的内存映射总是按照 DataFileSize 映射，不会映射超出数据文件大小的空间
+func (db *DB) preallocateActiveFile() error {
+	if (!db.options.Preallocate && !db.options.MMapWrites) || db.activeFile == nil {
+		return nil
+	}
+	if preallocator, ok := db.activeFile.IOManager.(fio.Preallocator); ok {
+		return preallocator.Preallocate(db.options.DataFileSize)
+	}
+	return nil
+}
+
+// 为活跃文件加上写缓冲
+func (db *DB) bufferActiveFile() error {
+	if db.options.WriteBufferSize == 0 || db.activeFile == nil {
+		return nil
+	}
+	manager, err := fio.NewBufferedIOManager(db.activeFile.IOManager, db.options.WriteBufferSize)
+	if err != nil {
+		return err
+	}
+	db.activeFile.IOManager = manager
+	return nil
+}
+
+// 将写缓冲区中的数据写入文件，并去掉数据文件的写缓冲
+func unbufferDataFile(dataFile *data.DataFile) error {
+	bufferedIO, ok := dataFile.IOManager.(*fio.BufferedIO)
+	if !ok {
+		return nil
+	}
+	if err := bufferedIO.Flush(); err != nil {
+		return err
+	}
+	dataFile.IOManager = bufferedIO.Unwrap()
+	return nil
+}
+
+// 将活跃文件写缓冲区中的数据写入文件，不进行持久化
+// 在访问此方法时必须持有锁，读锁即可
+func (db *DB) flushWriteBuffer() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	if bufferedIO, ok := db.activeFile.IOManager.(*fio.BufferedIO); ok {
+		return bufferedIO.Flush()
+	}
+	return nil
+}
+
+// 定时将写缓冲区中的数据写入文件，直到 DB 被关闭
+func (db *DB) flushWriteBufferPeriodically(interval time.Duration) {
+	defer db.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			db.mu.RLock()
+			// 写入失败时数据保留在缓冲区中，下一次写入或者 Sync 时会返回错误
+			_ = db.flushWriteBuffer()
+			db.mu.RUnlock()
+		}
+	}
+}
+
+// 定时持久化活跃文件，直到 DB 被关闭
+func (db *DB) syncPeriodically(interval time.Duration) {
+	defer db.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			db.mu.Lock()
+			// 上一次持久化之后没有新写入的数据则跳过
+			// 持久化失败时通过 EventListener.OnSync 通知，下一次会重试
+			if db.activeFile != nil && (db.activeFile.FileId != db.syncedFileId ||
+				db.activeFile.WriteOff != db.syncedOffset) {
+				_ = db.syncActiveFile()
+			}
+			db.mu.Unlock()
+		}
+	}
+}
+
+// 通知后台任务退出并等待退出完成
+func (db *DB) stopBackground() {
+	db.closeOnce.Do(func() {
+		close(db.closeCh)
+	})
+	db.background.Wait()
+}
@@ -1,10 +1,17 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
 	"bitcask-go/utils"
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // 测试完成之后销毁 DB 数据目录
@@ -322,6 +329,40 @@ func TestDB_FileLock(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// 打开失败时释放文件锁，修复数据目录之后可以重新打开
+func TestDB_FileLock_OpenFailed(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-filelock-open-failed")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(20)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 损坏第一条数据，加载索引时失败
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	corrupted := append([]byte{}, content...)
+	corrupted[0] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, corrupted, 0644))
+	for i := 0; i < 2; i++ {
+		_, err = Open(opts)
+		assert.Equal(t, data.ErrInvalidCRC, err)
+	}
+
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
+
 func TestDB_Stat(t *testing.T) {
 	opts := DefaultOptions
 	dir, _ := os.MkdirTemp("", "bitcask-go-stat")
@@ -376,6 +417,57 @@ func TestDB_Backup(t *testing.T) {
 	assert.NotNil(t, db2)
 }
 
+func TestDB_FoldContext(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-fold-ctx")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int
+	err = db.FoldContext(ctx, func(key []byte, value []byte) bool {
+		count++
+		if count == 10 {
+			cancel()
+		}
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 10, count)
+}
+
+func TestDB_BackupContext(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-ctx")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	// 取消的备份不会留下不完整的目标目录
+	backupDir := filepath.Join(os.TempDir(), "bitcask-go-backup-ctx-test")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.BackupContext(ctx, backupDir)
+	assert.Equal(t, context.Canceled, err)
+	_, err = os.Stat(backupDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
 //func TestDB_Open2(t *testing.T) {
 //	opts := DefaultOptions
 //	opts.DirPath = "/tmp/bitcask-go"
@@ -388,3 +480,459 @@ func TestDB_Backup(t *testing.T) {
 //	assert.Nil(t, err)
 //	assert.NotNil(t, db)
 //}
+
+// 自定义索引，persistent 为 true 时声明索引中已经保存了所有的数据
+type testCustomIndexer struct {
+	*index.BTree
+	persistent bool
+}
+
+func (ti *testCustomIndexer) Persistent() bool {
+	return ti.persistent
+}
+
+func TestDB_IndexerFactory(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-indexer-factory")
+	opts.DirPath = dir
+	opts.IndexType = Custom
+	shared := &testCustomIndexer{BTree: index.NewBTree()}
+	var factoryDir string
+	opts.IndexerFactory = func(dirPath string, sync bool) (index.Indexer, error) {
+		factoryDir = dirPath
+		return shared, nil
+	}
+
+	// IndexType 和工厂函数需要同时设置
+	badOpts := opts
+	badOpts.IndexerFactory = nil
+	_, err := Open(badOpts)
+	assert.NotNil(t, err)
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, dir, factoryDir)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 非持久化的索引从数据文件中加载
+	shared.BTree = index.NewBTree()
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, db2.index.Size())
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 持久化的索引跳过数据文件的重放
+	shared.BTree = index.NewBTree()
+	shared.persistent = true
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, db3.index.Size())
+}
+
+func TestDB_IndexerFactoryMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-indexer-factory-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = Custom
+	shared := &testCustomIndexer{BTree: index.NewBTree(), persistent: true}
+	opts.IndexerFactory = func(dirPath string, sync bool) (index.Indexer, error) {
+		return shared, nil
+	}
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// 安装 merge 之后数据的位置发生了变化，持久化的索引需要重建
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, db2.index.Size())
+	for i := 0; i < 1000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		if i < 500 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_MaxIndexMemory(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-index-memory")
+	opts.DirPath = dir
+	opts.MaxIndexMemory = 10 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	var count int
+	for ; count < 1000; count++ {
+		if err = db.Put(utils.GetTestKey(count), utils.RandomValue(10)); err != nil {
+			break
+		}
+	}
+	assert.True(t, errors.Is(err, ErrIndexMemoryExceeded))
+	assert.Greater(t, count, 0)
+	assert.LessOrEqual(t, db.Stat().IndexMemory, opts.MaxIndexMemory)
+
+	// 覆盖已有的 key 和删除不受限制
+	err = db.Put(utils.GetTestKey(0), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(0), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	// 事务中的新 key 同样受限制
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(count), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.True(t, errors.Is(err, ErrIndexMemoryExceeded))
+}
+
+func TestDB_MMapWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-writes")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MMapWrites = true
+	defer os.RemoveAll(dir)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+	val, err := db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Nil(t, db.Sync())
+
+	// 映射的空间不会超过数据文件的大小
+	stat, err := os.Stat(data.GetDataFileName(dir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	assert.Equal(t, opts.DataFileSize, stat.Size())
+
+	// 备份时活跃文件还带有预分配的空间，相当于进程崩溃时磁盘上的状态
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-mmap-writes-backup")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, db.Backup(backupDir))
+
+	// 重启之后继续使用 mmap 写入
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Nil(t, db2.Put(utils.GetTestKey(1000), utils.RandomValue(128)))
+	assert.Nil(t, db2.Close())
+
+	// 关闭之后活跃文件截断为实际的大小
+	activeFile := data.GetDataFileName(dir, db2.activeFile.FileId)
+	stat, err = os.Stat(activeFile)
+	assert.Nil(t, err)
+	assert.Equal(t, db2.activeFile.WriteOff, stat.Size())
+
+	// 预分配的空间在启动时被截断，使用标准文件IO写入的数据在重启之后仍然可读
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupOpts.MMapWrites = false
+	db3, err := Open(backupOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, db3.Put(utils.GetTestKey(2000), utils.RandomValue(128)))
+	assert.Nil(t, db3.Close())
+	db4, err := Open(backupOpts)
+	defer destroyDB(db4)
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, len(db4.ListKeys()))
+	_, err = db4.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+}
+
+func TestDB_WriteBuffer(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-write-buffer")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.WriteBufferSize = 32 * 1024
+	opts.WriteBufferFlushInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 缓冲区中的数据也可以读取到
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(128))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 定时写入文件
+	activeFile := data.GetDataFileName(dir, db.activeFile.FileId)
+	assert.Eventually(t, func() bool {
+		stat, err := os.Stat(activeFile)
+		return err == nil && stat.Size() == db.activeFile.WriteOff
+	}, time.Second, 10*time.Millisecond)
+
+	// 切换活跃文件时缓冲区中的数据写入旧的数据文件
+	for i := 2; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+	for _, dataFile := range db.olderFiles {
+		_, ok := dataFile.IOManager.(*fio.BufferedIO)
+		assert.False(t, ok)
+	}
+
+	// 重启校验
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, 999, len(db2.ListKeys()))
+}
+
+func TestDB_Preallocate(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-preallocate")
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-preallocate-backup")
+	defer func() {
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(backupDir)
+	}()
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.Preallocate = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+	// 写满的文件截断为实际大小
+	for _, dataFile := range db.olderFiles {
+		stat, err := os.Stat(data.GetDataFileName(dir, dataFile.FileId))
+		assert.Nil(t, err)
+		assert.Equal(t, dataFile.WriteOff, stat.Size())
+	}
+	activeFile := data.GetDataFileName(dir, db.activeFile.FileId)
+	stat, err := os.Stat(activeFile)
+	assert.Nil(t, err)
+	if stat.Size() != opts.DataFileSize {
+		_ = db.Close()
+		t.Skip("preallocation is not supported")
+	}
+
+	// 备份的活跃文件带着预分配的空间，相当于崩溃之后的数据目录
+	assert.Nil(t, db.Backup(backupDir))
+	writeOff := db.activeFile.WriteOff
+	assert.Nil(t, db.Close())
+	stat, err = os.Stat(activeFile)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, stat.Size())
+
+	// 预分配的空间被当作文件的末尾，重启之后从实际的末尾继续写入
+	opts.DirPath = backupDir
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, db.activeFile.WriteOff)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	assert.Nil(t, db.Put(utils.GetTestKey(1000), utils.RandomValue(128)))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, len(db.ListKeys()))
+	for i := 0; i <= 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+}
+
+// 预分配的活跃文件末尾有写了一半的数据，之后的空间全为 0，重启时当作文件的末尾截断
+func TestDB_Preallocate_TornTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-preallocate-torn")
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-preallocate-torn-backup")
+	defer func() {
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(backupDir)
+	}()
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.Preallocate = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	stat, err := os.Stat(data.GetDataFileName(dir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	if stat.Size() != opts.DataFileSize {
+		_ = db.Close()
+		t.Skip("preallocation is not supported")
+	}
+	assert.Nil(t, db.Backup(backupDir))
+	fileId, writeOff := db.activeFile.FileId, db.activeFile.WriteOff
+	assert.Nil(t, db.Close())
+
+	// 只写入了一半的数据
+	record, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(100), nonTransactionSeqNo),
+		Value: utils.RandomValue(128),
+		Type:  data.LogRecordNormal,
+	})
+	file, err := os.OpenFile(data.GetDataFileName(backupDir, fileId), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt(record[:len(record)/2], writeOff)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	opts.DirPath = backupDir
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, db.activeFile.WriteOff)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(100), utils.RandomValue(128)))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+
+	// 校验失败的数据之后还有其他数据，不是写了一半的末尾，打开失败
+	file, err = os.OpenFile(data.GetDataFileName(backupDir, fileId), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte{0xff}, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+}
+
+func TestDB_SyncInterval(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sync-interval")
+	opts.DirPath = dir
+	opts.SyncInterval = 10 * time.Millisecond
+	listener := &recordingListener{}
+	opts.EventListener = listener
+	db, err := Open(opts)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	assert.Nil(t, err)
+
+	// 定时持久化新写入的数据
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(128)))
+	assert.Eventually(t, func() bool {
+		stat := db.Stat()
+		return stat.SyncedFileId == db.activeFile.FileId && stat.SyncedOffset == db.activeFile.WriteOff
+	}, time.Second, 10*time.Millisecond)
+
+	// 没有新写入的数据时不会重复持久化
+	listener.mu.Lock()
+	syncs := len(listener.syncs)
+	listener.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	listener.mu.Lock()
+	assert.Equal(t, syncs, len(listener.syncs))
+	listener.mu.Unlock()
+
+	// 关闭之后后台任务退出
+	assert.Nil(t, db.Close())
+	listener.mu.Lock()
+	syncs = len(listener.syncs)
+	listener.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	listener.mu.Lock()
+	assert.Equal(t, syncs, len(listener.syncs))
+	listener.mu.Unlock()
+}
+
+func TestDB_InMemory(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-in-memory")
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.InMemory = true
+	opts.FileSystem = fio.NewMemFileSystem()
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Merge())
+
+	// 备份到同一个内存文件系统中
+	backupDir := filepath.Join(os.TempDir(), "bitcask-go-in-memory-backup")
+	assert.Nil(t, db.Backup(backupDir))
+
+	// 重启之后加载 merge 的结果
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db2.Close())
+
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	db3, err := Open(backupOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(db3.ListKeys()))
+	val, err := db3.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Nil(t, db3.Close())
+
+	// 没有访问磁盘
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(backupDir)
+	assert.True(t, os.IsNotExist(err))
+
+	// 内存中不支持 B+ 树索引
+	opts.IndexType = BPlusTree
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
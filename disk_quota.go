@@ -0,0 +1,116 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// 是否设置了磁盘配额
+func (db *DB) diskQuotaEnabled() bool {
+	return db.options.MaxDiskSize > 0 || db.options.MinFreeDiskSpace > 0
+}
+
+// 重新统计数据目录的磁盘占用和磁盘剩余空间
+// 需要遍历数据目录，只在打开数据库、切换活跃文件和 merge 之后调用，需要持有锁
+func (db *DB) refreshDiskUsage() error {
+	if !db.diskQuotaEnabled() {
+		return nil
+	}
+	dirSize, err := db.dataDirSize()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&db.diskUsage, dirSize)
+	return db.refreshDiskAvailable()
+}
+
+// 重新查询磁盘剩余空间，需要持有锁
+func (db *DB) refreshDiskAvailable() error {
+	available, err := db.fs.AvailableSize(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	unwritten, err := db.unwrittenSize()
+	if err != nil {
+		return err
+	}
+	// 预分配的空间已经从剩余空间中扣除，写入时还会再扣除一次
+	if available > math.MaxInt64-uint64(unwritten) {
+		available = math.MaxInt64 - uint64(unwritten)
+	}
+	atomic.StoreInt64(&db.diskAvailable, int64(available)+unwritten)
+	return nil
+}
+
+// 统计数据目录中已经写入的数据的大小，需要持有锁
+// 活跃文件预分配和可写内存映射扩展的空间还没有写入数据，不计入目录的大小，
+// 否则 merge 的比例、merge 需要的空间和磁盘配额都会按照整个数据文件的大小计算
+func (db *DB) dataDirSize() (int64, error) {
+	size, err := db.fs.DirSize(db.options.DirPath)
+	if err != nil {
+		return 0, err
+	}
+	unwritten, err := db.unwrittenSize()
+	if err != nil {
+		return 0, err
+	}
+	return size - unwritten, nil
+}
+
+// 活跃文件末尾已经分配、还没有写入数据的空间大小，需要持有锁
+func (db *DB) unwrittenSize() (int64, error) {
+	if db.activeFile == nil {
+		return 0, nil
+	}
+	info, err := db.fs.Stat(data.GetDataFileName(db.options.DirPath, db.activeFile.FileId))
+	if err != nil {
+		return 0, err
+	}
+	if unwritten := info.Size() - db.activeFile.WriteOff; unwritten > 0 {
+		return unwritten, nil
+	}
+	return 0, nil
+}
+
+// 写入数据文件之后更新磁盘占用的估算值
+func (db *DB) trackDiskUsage(size int64) {
+	if !db.diskQuotaEnabled() {
+		return
+	}
+	atomic.AddInt64(&db.diskUsage, size)
+	atomic.AddInt64(&db.diskAvailable, -size)
+}
+
+// 检查写入 size 字节之后是否会超过磁盘配额
+// 磁盘占用使用写入时更新的估算值，超过配额时不会重新遍历数据目录，merge 之后重新统计
+// 剩余空间可能被其他进程释放，低于下限时重新查询一次，只需要一次系统调用
+func (db *DB) checkDiskQuota(size int64) error {
+	if !db.diskQuotaEnabled() {
+		return nil
+	}
+	if err := db.diskQuotaError(size); err == nil || db.options.MinFreeDiskSpace <= 0 {
+		return err
+	}
+	if err := db.refreshDiskAvailable(); err != nil {
+		return err
+	}
+	return db.diskQuotaError(size)
+}
+
+func (db *DB) diskQuotaError(size int64) error {
+	if limit := db.options.MaxDiskSize; limit > 0 {
+		if usage := atomic.LoadInt64(&db.diskUsage); usage+size > limit {
+			return fmt.Errorf("%w: disk usage %d bytes, limit %d bytes",
+				ErrDiskQuotaExceeded, usage, limit)
+		}
+	}
+	if limit := db.options.MinFreeDiskSpace; limit > 0 {
+		if available := atomic.LoadInt64(&db.diskAvailable); available-size < limit {
+			return fmt.Errorf("%w: available disk space %d bytes, minimum %d bytes",
+				ErrDiskQuotaExceeded, available, limit)
+		}
+	}
+	return nil
+}
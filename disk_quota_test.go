@@ -0,0 +1,160 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDB_MaxDiskSize(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-disk-size")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.MaxDiskSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 一直写入直到超过配额
+	var written int
+	for ; written < 1000; written++ {
+		err = db.Put(utils.GetTestKey(written), utils.RandomValue(1024))
+		if err != nil {
+			break
+		}
+	}
+	assert.True(t, errors.Is(err, ErrDiskQuotaExceeded))
+	assert.True(t, written > 0)
+	dirSize, err := utils.DirSize(dir)
+	assert.Nil(t, err)
+	assert.True(t, dirSize <= opts.MaxDiskSize)
+
+	// 失败的写入不会修改数据文件
+	writeOff := db.activeFile.WriteOff
+	err = db.Put(utils.GetTestKey(written), utils.RandomValue(1024))
+	assert.True(t, errors.Is(err, ErrDiskQuotaExceeded))
+	assert.Equal(t, writeOff, db.activeFile.WriteOff)
+
+	// 包含新数据的批次同样被拒绝，只有删除的批次可以提交
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(written), utils.RandomValue(1024)))
+	assert.True(t, errors.Is(wb.Commit(), ErrDiskQuotaExceeded))
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, wb.Commit())
+
+	// 删除和 merge 不受配额限制
+	for i := 1; i < written/2; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+
+	// 重启之后 merge 的结果生效，空间被回收，可以继续写入
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(written), utils.RandomValue(1024)))
+	_, err = db.Get(utils.GetTestKey(written - 1))
+	assert.Nil(t, err)
+}
+
+// 统计 DirSize 调用次数的文件系统
+type dirSizeCountingFileSystem struct {
+	fio.FileSystem
+	calls int32
+}
+
+func (fs *dirSizeCountingFileSystem) DirSize(dirPath string) (int64, error) {
+	atomic.AddInt32(&fs.calls, 1)
+	return fs.FileSystem.DirSize(dirPath)
+}
+
+// 超过配额之后失败的写入不会重新遍历数据目录
+func TestDB_MaxDiskSize_CachedUsage(t *testing.T) {
+	fs := &dirSizeCountingFileSystem{FileSystem: fio.NewMemFileSystem()}
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-max-disk-size-cached"
+	opts.FileSystem = fs
+	opts.DataFileSize = 16 * 1024
+	opts.MaxDiskSize = 64 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	var written int
+	for ; written < 1000; written++ {
+		err = db.Put(utils.GetTestKey(written), utils.RandomValue(1024))
+		if err != nil {
+			break
+		}
+	}
+	assert.True(t, errors.Is(err, ErrDiskQuotaExceeded))
+	calls := atomic.LoadInt32(&fs.calls)
+	for i := 0; i < 100; i++ {
+		err = db.Put(utils.GetTestKey(written), utils.RandomValue(1024))
+		assert.True(t, errors.Is(err, ErrDiskQuotaExceeded))
+	}
+	assert.Equal(t, calls, atomic.LoadInt32(&fs.calls))
+}
+
+// 预分配的活跃文件只按照已经写入的数据计算磁盘占用和 merge 的比例
+func TestDB_MaxDiskSize_Preallocate(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-disk-size-preallocate")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	opts.Preallocate = true
+	opts.MaxDiskSize = 256 * 1024
+	opts.DataFileMergeRatio = 0.4
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(1024)))
+	stat, err := os.Stat(data.GetDataFileName(dir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	if stat.Size() != opts.DataFileSize {
+		t.Skip("preallocation is not supported")
+	}
+
+	for i := 1; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.refreshDiskUsage())
+	assert.True(t, db.diskUsage < opts.MaxDiskSize)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(1024)))
+	assert.Nil(t, db.Merge())
+}
+
+func TestDB_MinFreeDiskSpace(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-min-free-disk-space")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(128)))
+	assert.Nil(t, db.Close())
+
+	// 剩余空间不可能满足下限，所有的写入都被拒绝
+	opts.MinFreeDiskSpace = math.MaxInt64
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(128))
+	assert.True(t, errors.Is(err, ErrDiskQuotaExceeded))
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
@@ -3,14 +3,21 @@ package bitcask_go
 import "errors"
 
 var (
-	ErrKeyIsEmpty             = errors.New("the key is empty")
-	ErrIndexUpdateFailed      = errors.New("failed to update index")
-	ErrKeyNotFound            = errors.New("key not found in database")
-	ErrDataFileNotFound       = errors.New("data file is not found")
-	ErrDataDirectoryCorrupted = errors.New("the database directory maybe corrupted")
-	ErrExceedMaxBatchNum      = errors.New("exceed the max batch num")
-	ErrMergeIsProgress        = errors.New("merge is in progress, try again later")
-	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
-	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
-	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrKeyIsEmpty               = errors.New("the key is empty")
+	ErrIndexUpdateFailed        = errors.New("failed to update index")
+	ErrKeyNotFound              = errors.New("key not found in database")
+	ErrDataFileNotFound         = errors.New("data file is not found")
+	ErrDataDirectoryCorrupted   = errors.New("the database directory maybe corrupted")
+	ErrExceedMaxBatchNum        = errors.New("exceed the max batch num")
+	ErrMergeIsProgress          = errors.New("merge is in progress, try again later")
+	ErrDatabaseIsUsing          = errors.New("the database directory is used by another process")
+	ErrMergeRatioUnreached      = errors.New("the merge ratio do not reach the option")
+	ErrNoEnoughSpaceForMerge    = errors.New("no enough disk space for merge")
+	ErrManifestCorrupted        = errors.New("the manifest file is corrupted")
+	ErrUnsupportedFormatVersion = errors.New("the data directory format version is not supported")
+	ErrIndexTypeMismatch        = errors.New("the index type does not match the data directory")
+	ErrSeekUnsupported          = errors.New("seek is not supported by the unordered index")
+	ErrReverseUnsupported       = errors.New("reverse iteration is not supported by the unordered index")
+	ErrIndexMemoryExceeded      = errors.New("the index memory usage exceeds the limit")
+	ErrDiskQuotaExceeded        = errors.New("the disk usage exceeds the quota")
 )
@@ -0,0 +1,116 @@
+package bitcask_go
+
+import "time"
+
+// EventListener 存储引擎内部事件的监听器，可以用于记录日志和告警
+// 回调在触发事件的 goroutine 中同步执行，部分回调执行时持有数据库的锁，
+// 因此实现中不能再调用 DB 的方法，也不应该长时间阻塞
+type EventListener interface {
+	// OnFileRotated 活跃文件写满，切换到新的活跃文件
+	OnFileRotated(info FileRotationInfo)
+	// OnSync 活跃文件执行了一次持久化
+	OnSync(info SyncInfo)
+	// OnMergeStart merge 开始
+	OnMergeStart(info MergeStartInfo)
+	// OnMergeFinish merge 成功完成
+	OnMergeFinish(info MergeFinishInfo)
+	// OnMergeFailed merge 开始之后执行失败
+	OnMergeFailed(info MergeFailedInfo)
+	// OnRecovery Open 过程中执行的恢复动作
+	OnRecovery(info RecoveryInfo)
+	// OnBackupFinish 备份完成（包括失败的情况）
+	OnBackupFinish(info BackupInfo)
+	// OnClose 数据库关闭
+	OnClose(info CloseInfo)
+}
+
+// BaseEventListener 空实现的事件监听器，可以嵌入到自定义监听器中，只实现关心的回调
+type BaseEventListener struct{}
+
+func (BaseEventListener) OnFileRotated(FileRotationInfo) {}
+func (BaseEventListener) OnSync(SyncInfo)                {}
+func (BaseEventListener) OnMergeStart(MergeStartInfo)    {}
+func (BaseEventListener) OnMergeFinish(MergeFinishInfo)  {}
+func (BaseEventListener) OnMergeFailed(MergeFailedInfo)  {}
+func (BaseEventListener) OnRecovery(RecoveryInfo)        {}
+func (BaseEventListener) OnBackupFinish(BackupInfo)      {}
+func (BaseEventListener) OnClose(CloseInfo)              {}
+
+// FileRotationInfo 活跃文件切换的信息
+type FileRotationInfo struct {
+	OldFileId   uint32 // 转换为旧数据文件的文件id
+	OldFileSize int64  // 旧活跃文件的大小
+	NewFileId   uint32 // 新活跃文件的id
+}
+
+// SyncInfo 持久化的信息
+type SyncInfo struct {
+	FileId   uint32        // 持久化的文件id
+	Offset   int64         // 持久化时文件写到的位置
+	Duration time.Duration // fsync 耗时
+	Err      error         // 持久化失败时的错误
+}
+
+// MergeStartInfo merge 开始时的信息
+type MergeStartInfo struct {
+	MergeFileIds    []uint32 // 参与 merge 的文件id
+	NonMergeFileId  uint32   // 最近没有参与 merge 的文件id
+	TotalSize       int64    // 数据目录的大小
+	ReclaimableSize int64    // 可以回收的数据量
+}
+
+// MergeFinishInfo merge 完成时的信息
+type MergeFinishInfo struct {
+	MergeFileIds   []uint32      // 参与 merge 的文件id
+	NonMergeFileId uint32        // 最近没有参与 merge 的文件id
+	ReclaimedBytes int64         // 回收的字节数
+	Duration       time.Duration // merge 耗时
+}
+
+// MergeFailedInfo merge 失败时的信息
+type MergeFailedInfo struct {
+	Err      error         // 失败的原因
+	Duration time.Duration // 失败前已经执行的时间
+}
+
+// RecoveryAction Open 过程中的恢复动作类型
+type RecoveryAction = byte
+
+const (
+	// RecoveryMergeInstalled 将已完成的 merge 数据文件安装到数据目录
+	RecoveryMergeInstalled RecoveryAction = iota + 1
+
+	// RecoveryMergeDiscarded 丢弃未完成的 merge 目录
+	RecoveryMergeDiscarded
+
+	// RecoveryHintLoaded 从 hint 文件中加载索引
+	RecoveryHintLoaded
+
+	// RecoveryDataFilesReplayed 从数据文件中加载索引
+	RecoveryDataFilesReplayed
+
+	// RecoverySeqNoLoaded 从 seq-no 文件中加载事务序列号
+	RecoverySeqNoLoaded
+)
+
+// RecoveryInfo Open 过程中恢复动作的信息
+type RecoveryInfo struct {
+	Action   RecoveryAction // 恢复动作
+	FileIds  []uint32       // 涉及的数据文件id
+	Records  int            // 处理的记录条数
+	Duration time.Duration  // 耗时
+}
+
+// BackupInfo 备份的信息
+type BackupInfo struct {
+	Dir      string        // 备份的目标目录
+	Duration time.Duration // 备份耗时
+	Err      error         // 备份失败时的错误
+}
+
+// CloseInfo 关闭数据库的信息
+type CloseInfo struct {
+	ActiveFileId uint32 // 关闭时的活跃文件id
+	SeqNo        uint64 // 关闭时的事务序列号
+	Err          error  // 关闭过程中的错误
+}
@@ -0,0 +1,184 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 记录所有事件的监听器
+type recordingListener struct {
+	BaseEventListener
+	mu          sync.Mutex
+	rotations   []FileRotationInfo
+	syncs       []SyncInfo
+	mergeStarts []MergeStartInfo
+	mergeFins   []MergeFinishInfo
+	mergeFails  []MergeFailedInfo
+	recoveries  []RecoveryInfo
+	backups     []BackupInfo
+	closes      []CloseInfo
+}
+
+func (l *recordingListener) OnFileRotated(info FileRotationInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rotations = append(l.rotations, info)
+}
+
+func (l *recordingListener) OnSync(info SyncInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncs = append(l.syncs, info)
+}
+
+func (l *recordingListener) OnMergeStart(info MergeStartInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeStarts = append(l.mergeStarts, info)
+}
+
+func (l *recordingListener) OnMergeFinish(info MergeFinishInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeFins = append(l.mergeFins, info)
+}
+
+func (l *recordingListener) OnMergeFailed(info MergeFailedInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeFails = append(l.mergeFails, info)
+}
+
+func (l *recordingListener) OnRecovery(info RecoveryInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recoveries = append(l.recoveries, info)
+}
+
+func (l *recordingListener) OnBackupFinish(info BackupInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.backups = append(l.backups, info)
+}
+
+func (l *recordingListener) OnClose(info CloseInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closes = append(l.closes, info)
+}
+
+func TestDB_EventListener(t *testing.T) {
+	listener := &recordingListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-events")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.EventListener = listener
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(listener.rotations) > 0)
+	assert.Equal(t, uint32(0), listener.rotations[0].OldFileId)
+	assert.Equal(t, uint32(1), listener.rotations[0].NewFileId)
+	assert.True(t, len(listener.syncs) >= len(listener.rotations))
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(listener.mergeStarts))
+	assert.Equal(t, 1, len(listener.mergeFins))
+	assert.Equal(t, listener.mergeStarts[0].NonMergeFileId, listener.mergeFins[0].NonMergeFileId)
+	assert.Equal(t, len(listener.mergeStarts[0].MergeFileIds), int(listener.mergeStarts[0].NonMergeFileId))
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-events-backup")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(listener.backups))
+	assert.Equal(t, backupDir, listener.backups[0].Dir)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(listener.closes))
+	assert.Nil(t, listener.closes[0].Err)
+
+	// 重启后安装 merge 文件，并从 hint 文件和数据文件中加载索引
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	var actions []RecoveryAction
+	for _, info := range listener.recoveries {
+		actions = append(actions, info.Action)
+	}
+	assert.Contains(t, actions, RecoveryMergeInstalled)
+	assert.Contains(t, actions, RecoveryHintLoaded)
+	assert.Contains(t, actions, RecoveryDataFilesReplayed)
+}
+
+// merge 开始之后统计目录大小失败的文件系统
+type dirSizeFaultFileSystem struct {
+	fio.FileSystem
+	fail int32
+}
+
+var errDirSizeFault = errors.New("dir size fault")
+
+func (fs *dirSizeFaultFileSystem) DirSize(dirPath string) (int64, error) {
+	if atomic.LoadInt32(&fs.fail) == 1 {
+		return 0, errDirSizeFault
+	}
+	return fs.FileSystem.DirSize(dirPath)
+}
+
+// merge 完成之后刷新磁盘占用失败，同样通知监听器
+type failAfterMergeStartListener struct {
+	recordingListener
+	fs *dirSizeFaultFileSystem
+}
+
+func (l *failAfterMergeStartListener) OnMergeStart(info MergeStartInfo) {
+	l.recordingListener.OnMergeStart(info)
+	atomic.StoreInt32(&l.fs.fail, 1)
+}
+
+func TestDB_EventListener_MergeFailed(t *testing.T) {
+	fs := &dirSizeFaultFileSystem{FileSystem: fio.NewMemFileSystem()}
+	listener := &failAfterMergeStartListener{fs: fs}
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-events-merge-failed"
+	opts.FileSystem = fs
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.MaxDiskSize = 1024 * 1024 * 1024
+	opts.EventListener = listener
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		atomic.StoreInt32(&fs.fail, 0)
+		_ = db.Close()
+	}()
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.True(t, errors.Is(err, errDirSizeFault))
+	assert.Equal(t, 1, len(listener.mergeStarts))
+	assert.Equal(t, 0, len(listener.mergeFins))
+	assert.Equal(t, 1, len(listener.mergeFails))
+	assert.Equal(t, err, listener.mergeFails[0].Err)
+}
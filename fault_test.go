@@ -0,0 +1,565 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	errInjectedFault = errors.New("injected fault")
+	errCrashed       = errors.New("process crashed")
+)
+
+type faultKind int
+
+const (
+	faultWriteError    faultKind = iota // 第 N 次写入返回错误，不写入任何数据
+	faultSyncError                      // 第 N 次 Sync 返回错误，数据没有被持久化
+	faultShortWrite                     // 第 N 次写入只写入一半的数据并返回错误，进程继续运行
+	faultTornWrite                      // 第 N 次写入只写入一半的数据，然后进程崩溃
+	faultTornHeader                     // 第 N 次写入只写入 header 的一部分，然后进程崩溃
+	faultMetadataCrash                  // 第 N 次创建、重命名或者删除文件时进程崩溃，操作不会执行
+)
+
+func (k faultKind) String() string {
+	switch k {
+	case faultWriteError:
+		return "write-error"
+	case faultSyncError:
+		return "sync-error"
+	case faultShortWrite:
+		return "short-write"
+	case faultTornWrite:
+		return "torn-write"
+	case faultMetadataCrash:
+		return "metadata-crash"
+	default:
+		return "torn-header"
+	}
+}
+
+// faultFileSystem 用于崩溃一致性测试的文件系统，基于内存文件系统注入故障
+// 记录每个文件最后一次 Sync 时的大小，模拟崩溃时可以丢弃所有没有持久化的写入；
+// 文件的创建和重命名在所在的目录 SyncDir 之后才会持久化，删除和创建目录认为是立即持久化的
+type faultFileSystem struct {
+	*fio.MemFileSystem
+	lock     sync.Mutex
+	kind     faultKind
+	n        int               // 在第 n 次写入、Sync 或者修改目录时注入故障，0 表示不注入
+	writes   int               // 注入故障之后写入的次数
+	syncs    int               // 注入故障之后 Sync 的次数
+	metaOps  int               // 注入故障之后创建、重命名和删除文件的次数
+	fired    bool              // 故障是否已经发生
+	crashed  bool              // 进程是否已经崩溃，崩溃之后所有的写操作都失败
+	synced   map[string]int64  // 文件最后一次 Sync 时的大小
+	files    map[string]bool   // 打开过的文件
+	durable  map[string]bool   // 目录项已经持久化的文件
+	renamed  map[string]string // 重命名之后目录还没有持久化的文件，掉电之后恢复为原来的名字
+	fileLock []fio.FileLock    // 进程持有的文件锁，崩溃之后释放
+}
+
+func newFaultFileSystem() *faultFileSystem {
+	return &faultFileSystem{
+		MemFileSystem: fio.NewMemFileSystem(),
+		synced:        make(map[string]int64),
+		files:         make(map[string]bool),
+		durable:       make(map[string]bool),
+		renamed:       make(map[string]string),
+	}
+}
+
+// 在之后的第 n 次写入或者 Sync 时注入故障
+func (ffs *faultFileSystem) inject(kind faultKind, n int) {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	ffs.kind, ffs.n = kind, n
+	ffs.writes, ffs.syncs, ffs.metaOps, ffs.fired = 0, 0, 0, false
+}
+
+// 创建、重命名和删除文件之前调用，返回是否在这次操作时崩溃
+// 在访问此方法时必须持有 ffs.lock
+func (ffs *faultFileSystem) metadataCrash() bool {
+	ffs.metaOps++
+	if ffs.n > 0 && !ffs.fired && ffs.kind == faultMetadataCrash && ffs.metaOps == ffs.n {
+		ffs.fired, ffs.crashed = true, true
+	}
+	return ffs.crashed
+}
+
+// 模拟进程崩溃之后重启，dropUnsynced 为 true 时丢弃所有没有持久化的数据，相当于机器掉电
+func (ffs *faultFileSystem) restart(dropUnsynced bool) {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	ffs.n, ffs.crashed = 0, false
+	// 进程退出之后文件锁被释放
+	for _, fileLock := range ffs.fileLock {
+		_ = fileLock.Unlock()
+	}
+	ffs.fileLock = nil
+	if !dropUnsynced {
+		return
+	}
+	// 目录没有持久化时，新创建的文件丢失，重命名的文件恢复为原来的名字
+	for name := range ffs.files {
+		if ffs.durable[name] {
+			continue
+		}
+		if oldPath, ok := ffs.renamed[name]; ok && ffs.MemFileSystem.Rename(name, oldPath) == nil {
+			ffs.files[oldPath], ffs.durable[oldPath] = true, true
+			ffs.synced[oldPath] = ffs.synced[name]
+		} else {
+			_ = ffs.MemFileSystem.Remove(name)
+		}
+		delete(ffs.files, name)
+		delete(ffs.synced, name)
+	}
+	ffs.renamed = make(map[string]string)
+	for name := range ffs.files {
+		file, err := ffs.MemFileSystem.OpenFile(name, fio.StandardFIO)
+		if err != nil {
+			continue
+		}
+		if size, _ := file.Size(); size > ffs.synced[name] {
+			_ = file.Truncate(ffs.synced[name])
+		}
+	}
+}
+
+func (ffs *faultFileSystem) OpenFile(name string, ioType fio.FileIOType) (fio.IOManager, error) {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed {
+		return nil, errCrashed
+	}
+	if _, err := ffs.MemFileSystem.Stat(name); err != nil && ffs.metadataCrash() {
+		return nil, errCrashed
+	}
+	manager, err := ffs.MemFileSystem.OpenFile(name, ioType)
+	if err != nil {
+		return nil, err
+	}
+	name = path.Clean(name)
+	ffs.files[name] = true
+	return &faultFile{IOManager: manager, fs: ffs, name: name}, nil
+}
+
+func (ffs *faultFileSystem) Rename(oldPath, newPath string) error {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed || ffs.metadataCrash() {
+		return errCrashed
+	}
+	if err := ffs.MemFileSystem.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	oldPath, newPath = path.Clean(oldPath), path.Clean(newPath)
+	ffs.synced[newPath] = ffs.synced[oldPath]
+	ffs.files[newPath] = true
+	if ffs.durable[oldPath] {
+		ffs.renamed[newPath] = oldPath
+	} else if origPath, ok := ffs.renamed[oldPath]; ok {
+		ffs.renamed[newPath] = origPath
+	}
+	delete(ffs.durable, newPath)
+	ffs.forget(oldPath)
+	return nil
+}
+
+func (ffs *faultFileSystem) SyncDir(dirPath string) error {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed {
+		return errCrashed
+	}
+	if err := ffs.MemFileSystem.SyncDir(dirPath); err != nil {
+		return err
+	}
+	dirPath = path.Clean(dirPath)
+	for name := range ffs.files {
+		if path.Dir(name) == dirPath {
+			ffs.durable[name] = true
+			delete(ffs.renamed, name)
+		}
+	}
+	return nil
+}
+
+func (ffs *faultFileSystem) TryLock(name string) (fio.FileLock, bool, error) {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	fileLock, hold, err := ffs.MemFileSystem.TryLock(name)
+	if hold {
+		ffs.fileLock = append(ffs.fileLock, fileLock)
+	}
+	return fileLock, hold, err
+}
+
+// 不再跟踪被删除的文件
+// 在访问此方法时必须持有 ffs.lock
+func (ffs *faultFileSystem) forget(name string) {
+	delete(ffs.synced, name)
+	delete(ffs.files, name)
+	delete(ffs.durable, name)
+	delete(ffs.renamed, name)
+}
+
+func (ffs *faultFileSystem) Remove(name string) error {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed || ffs.metadataCrash() {
+		return errCrashed
+	}
+	if err := ffs.MemFileSystem.Remove(name); err != nil {
+		return err
+	}
+	ffs.forget(path.Clean(name))
+	return nil
+}
+
+func (ffs *faultFileSystem) RemoveAll(p string) error {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed || ffs.metadataCrash() {
+		return errCrashed
+	}
+	if err := ffs.MemFileSystem.RemoveAll(p); err != nil {
+		return err
+	}
+	p = path.Clean(p)
+	for name := range ffs.files {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			ffs.forget(name)
+		}
+	}
+	return nil
+}
+
+// faultFile 注入故障的 IOManager
+type faultFile struct {
+	fio.IOManager
+	fs   *faultFileSystem
+	name string
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	ffs := f.fs
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed {
+		return 0, errCrashed
+	}
+	ffs.writes++
+	if ffs.n == 0 || ffs.fired || ffs.writes != ffs.n {
+		return f.IOManager.Write(b)
+	}
+	switch ffs.kind {
+	case faultWriteError:
+		ffs.fired = true
+		return 0, errInjectedFault
+	case faultShortWrite:
+		ffs.fired = true
+		n, _ := f.IOManager.Write(b[:len(b)/2])
+		return n, errInjectedFault
+	case faultTornWrite:
+		ffs.fired, ffs.crashed = true, true
+		n, _ := f.IOManager.Write(b[:len(b)/2])
+		return n, errInjectedFault
+	case faultTornHeader:
+		ffs.fired, ffs.crashed = true, true
+		if len(b) > 5 {
+			b = b[:5]
+		}
+		n, _ := f.IOManager.Write(b)
+		return n, errInjectedFault
+	}
+	return f.IOManager.Write(b)
+}
+
+func (f *faultFile) Sync() error {
+	ffs := f.fs
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed {
+		return errCrashed
+	}
+	ffs.syncs++
+	if ffs.n > 0 && !ffs.fired && ffs.kind == faultSyncError && ffs.syncs == ffs.n {
+		ffs.fired = true
+		return errInjectedFault
+	}
+	if err := f.IOManager.Sync(); err != nil {
+		return err
+	}
+	size, err := f.IOManager.Size()
+	if err != nil {
+		return err
+	}
+	ffs.synced[f.name] = size
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	ffs := f.fs
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.crashed {
+		return errCrashed
+	}
+	if err := f.IOManager.Truncate(size); err != nil {
+		return err
+	}
+	if ffs.synced[f.name] > size {
+		ffs.synced[f.name] = size
+	}
+	return nil
+}
+
+// crashModel 记录已经确认成功的操作，用于校验崩溃恢复之后的数据
+type crashModel struct {
+	values  map[string][]byte // 确认写入成功的数据，nil 表示被删除
+	pending map[string][]byte // 失败的操作涉及的数据，恢复之后可能是旧值也可能是新值
+	atomic  bool              // 失败的操作是否是 WriteBatch，要么全部生效要么全部不生效
+}
+
+func crashTestValue(i, version int) []byte {
+	return []byte(fmt.Sprintf("bitcask-go-value-%d-%d-%s", i, version, strings.Repeat("v", 64)))
+}
+
+// 崩溃测试的工作负载：单条写入和删除、WriteBatch 以及 Merge
+// 遇到第一个错误时停止，返回是否完整执行
+func runCrashWorkload(db *DB, model *crashModel) bool {
+	put := func(i, version int) bool {
+		key, value := string(crashTestKey(i)), crashTestValue(i, version)
+		if err := db.Put([]byte(key), value); err != nil {
+			model.pending = map[string][]byte{key: value}
+			return false
+		}
+		model.values[key] = value
+		return true
+	}
+	del := func(i int) bool {
+		key := string(crashTestKey(i))
+		if err := db.Delete([]byte(key)); err != nil {
+			model.pending = map[string][]byte{key: nil}
+			return false
+		}
+		model.values[key] = nil
+		return true
+	}
+	batch := func(puts []int, deletes []int, version int) bool {
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		changes := make(map[string][]byte)
+		for _, i := range puts {
+			changes[string(crashTestKey(i))] = crashTestValue(i, version)
+			_ = wb.Put(crashTestKey(i), crashTestValue(i, version))
+		}
+		for _, i := range deletes {
+			changes[string(crashTestKey(i))] = nil
+			_ = wb.Delete(crashTestKey(i))
+		}
+		if err := wb.Commit(); err != nil {
+			model.pending, model.atomic = changes, true
+			return false
+		}
+		for key, value := range changes {
+			model.values[key] = value
+		}
+		return true
+	}
+
+	for i := 0; i < 30; i++ {
+		if !put(i, 0) {
+			return false
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if !del(i) {
+			return false
+		}
+	}
+	if !batch([]int{30, 31, 32, 33, 34, 35}, []int{10, 11, 12}, 0) {
+		return false
+	}
+	if err := db.Merge(); err != nil {
+		return false
+	}
+	for i := 15; i < 25; i++ {
+		if !put(i, 1) {
+			return false
+		}
+	}
+	return batch([]int{13, 14, 40, 41}, []int{30, 31}, 1)
+}
+
+func crashTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("bitcask-go-key-%03d", i))
+}
+
+// 校验恢复之后的数据和模型一致
+func checkCrashModel(t *testing.T, db *DB, model *crashModel, desc string) {
+	get := func(key string) []byte {
+		value, err := db.Get([]byte(key))
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		assert.Nil(t, err, desc)
+		return value
+	}
+	for key, value := range model.values {
+		if _, ok := model.pending[key]; ok {
+			continue
+		}
+		assert.True(t, bytes.Equal(value, get(key)), "%s: key %s", desc, key)
+	}
+
+	// 失败的操作可能生效也可能不生效，WriteBatch 要么全部生效要么全部不生效
+	applied := make(map[bool]int)
+	for key, value := range model.pending {
+		actual := get(key)
+		switch {
+		case bytes.Equal(actual, value):
+			applied[true]++
+		case bytes.Equal(actual, model.values[key]):
+			applied[false]++
+		default:
+			assert.Fail(t, "unexpected value after recovery", "%s: key %s", desc, key)
+		}
+	}
+	if model.atomic {
+		assert.False(t, applied[true] > 0 && applied[false] > 0, "%s: write batch partially applied", desc)
+	}
+}
+
+func TestDB_CrashRecovery(t *testing.T) {
+	kinds := []faultKind{faultWriteError, faultSyncError, faultShortWrite, faultTornWrite, faultTornHeader, faultMetadataCrash}
+	for _, kind := range kinds {
+		for _, dropUnsynced := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/drop-unsynced=%v", kind, dropUnsynced), func(t *testing.T) {
+				testCrashRecovery(t, kind, dropUnsynced)
+			})
+		}
+	}
+}
+
+func testCrashRecovery(t *testing.T, kind faultKind, dropUnsynced bool) {
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-crash"
+	opts.DataFileSize = 2 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.SyncWrites = true
+
+	// 依次在第 n 次操作时注入故障，直到工作负载可以完整执行
+	for n := 1; ; n++ {
+		desc := fmt.Sprintf("%s at operation %d, drop unsynced %v", kind, n, dropUnsynced)
+		ffs := newFaultFileSystem()
+		opts.FileSystem = ffs
+		db, err := Open(opts)
+		if !assert.Nil(t, err, desc) {
+			return
+		}
+
+		model := &crashModel{values: make(map[string][]byte)}
+		ffs.inject(kind, n)
+		completed := runCrashWorkload(db, model)
+		// 进程没有崩溃时，失败之后仍然可以继续写入
+		if !completed {
+			key, value := crashTestKey(101), crashTestValue(101, 0)
+			if err := db.Put(key, value); err == nil {
+				model.values[string(key)] = value
+			}
+		}
+		crashDB(db)
+		ffs.restart(dropUnsynced)
+
+		// 崩溃之后可以正常打开，确认成功的数据都在
+		db2, err := Open(opts)
+		if !assert.Nil(t, err, desc) {
+			return
+		}
+		checkCrashModel(t, db2, model, desc)
+
+		// 恢复之后可以继续写入，重启之后数据仍然可读
+		assert.Nil(t, db2.Put(crashTestKey(100), crashTestValue(100, 0)), desc)
+		assert.Nil(t, db2.Close(), desc)
+		db3, err := Open(opts)
+		if !assert.Nil(t, err, desc) {
+			return
+		}
+		model.values[string(crashTestKey(100))] = crashTestValue(100, 0)
+		checkCrashModel(t, db3, model, desc)
+		assert.Nil(t, db3.Close(), desc)
+
+		if completed {
+			assert.Greater(t, n, 1, desc)
+			return
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+// merge 之后重启时将 merge 目录中的文件移动到数据目录中，移动过程中的任意一步崩溃都不能丢失数据
+func TestDB_MergeInstallCrash(t *testing.T) {
+	for _, dropUnsynced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("drop-unsynced=%v", dropUnsynced), func(t *testing.T) {
+			testMergeInstallCrash(t, dropUnsynced)
+		})
+	}
+}
+
+func testMergeInstallCrash(t *testing.T, dropUnsynced bool) {
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-merge-install-crash"
+	opts.DataFileSize = 2 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.SyncWrites = true
+
+	for n := 1; ; n++ {
+		desc := fmt.Sprintf("crash at metadata operation %d, drop unsynced %v", n, dropUnsynced)
+		ffs := newFaultFileSystem()
+		opts.FileSystem = ffs
+		db, err := Open(opts)
+		if !assert.Nil(t, err, desc) {
+			return
+		}
+		model := &crashModel{values: make(map[string][]byte)}
+		if !assert.True(t, runCrashWorkload(db, model), desc) {
+			return
+		}
+		assert.Nil(t, db.Close(), desc)
+
+		// 第一次重启时移动 merge 目录中的文件，在第 n 次修改目录时崩溃
+		ffs.inject(faultMetadataCrash, n)
+		db2, err := Open(opts)
+		if err == nil {
+			assert.Nil(t, db2.Close(), desc)
+		}
+		ffs.lock.Lock()
+		fired := ffs.fired
+		ffs.lock.Unlock()
+		ffs.restart(dropUnsynced)
+
+		db3, err := Open(opts)
+		if !assert.Nil(t, err, desc) {
+			return
+		}
+		checkCrashModel(t, db3, model, desc)
+		assert.Nil(t, db3.Close(), desc)
+
+		if !fired {
+			assert.Greater(t, n, 1, desc)
+			return
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
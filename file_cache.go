@@ -0,0 +1,100 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"container/list"
+	"sync"
+)
+
+// fileCache 限制同时打开的旧数据文件数量的 LRU 缓存
+// 旧的数据文件始终保存在 olderFiles 中，被淘汰的文件只关闭文件句柄，下次读取时重新打开
+// 正在读取的文件不会被淘汰，所有文件都在使用时打开的文件数量会暂时超过容量
+type fileCache struct {
+	dirPath  string
+	capacity int
+	lock     sync.Mutex
+	entries  map[uint32]*fileCacheEntry
+	lru      *list.List // 打开的文件，最近访问的在前面
+}
+
+type fileCacheEntry struct {
+	file *data.DataFile
+	refs int           // 正在读取此文件的数量
+	elem *list.Element // 在 lru 中的位置，文件关闭时为空
+}
+
+func newFileCache(dirPath string, capacity int) *fileCache {
+	return &fileCache{
+		dirPath:  dirPath,
+		capacity: capacity,
+		entries:  make(map[uint32]*fileCacheEntry),
+		lru:      list.New(),
+	}
+}
+
+// 添加一个旧的数据文件，超过容量时关闭最久没有访问的文件
+func (c *fileCache) add(file *data.DataFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := &fileCacheEntry{file: file}
+	c.entries[file.FileId] = entry
+	if file.IsOpen() {
+		entry.elem = c.lru.PushFront(entry)
+	}
+	c.evict()
+}
+
+// 获取文件的读取权，文件已经被关闭时重新打开，读取完成之后需要调用返回的 release
+// 没有添加到缓存中的文件（例如活跃文件）不受限制，直接返回
+func (c *fileCache) acquire(file *data.DataFile) (func(), error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[file.FileId]
+	if !ok || entry.file != file {
+		return func() {}, nil
+	}
+	if entry.elem == nil {
+		if err := file.SetIOManager(c.dirPath, fio.StandardFIO); err != nil {
+			return nil, err
+		}
+		entry.elem = c.lru.PushFront(entry)
+	} else {
+		c.lru.MoveToFront(entry.elem)
+	}
+	entry.refs++
+	c.evict()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			entry.refs--
+			c.evict()
+		})
+	}, nil
+}
+
+// 当前打开的文件数量
+func (c *fileCache) openFiles() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// 从最久没有访问的文件开始，关闭没有在读取的文件，直到不超过容量
+// 在访问此方法时必须持有 c.lock
+func (c *fileCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.lru.Len() > c.capacity; {
+		prev := elem.Prev()
+		entry := elem.Value.(*fileCacheEntry)
+		if entry.refs == 0 {
+			// 只读的文件关闭失败不影响数据，下次读取时会重新打开
+			_ = entry.file.Close()
+			c.lru.Remove(elem)
+			entry.elem = nil
+		}
+		elem = prev
+	}
+}
@@ -0,0 +1,59 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_MaxOpenFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-open-files")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.MaxOpenFiles = 2
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.True(t, len(db.olderFiles) > opts.MaxOpenFiles)
+	assert.True(t, db.fileCache.openFiles() <= opts.MaxOpenFiles)
+
+	// 读取被关闭的文件时重新打开
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	assert.True(t, db.fileCache.openFiles() <= opts.MaxOpenFiles)
+
+	// merge 读取所有的旧数据文件
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.True(t, db.fileCache.openFiles() <= opts.MaxOpenFiles)
+
+	// 重启之后加载索引也不会超过限制
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, db.fileCache.openFiles() <= opts.MaxOpenFiles)
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i < 100 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	assert.True(t, db.fileCache.openFiles() <= opts.MaxOpenFiles)
+}
@@ -0,0 +1,156 @@
+package fio
+
+import (
+	"io"
+	"sync"
+)
+
+// BufferedIO 带写缓冲的 IO，包装底层的 IOManager
+// 写入先追加到内存缓冲区中，缓冲区达到阈值、Sync 或者 Flush 时一次性写入底层文件，
+// 读取还在缓冲区中的数据时直接从缓冲区返回
+type BufferedIO struct {
+	manager IOManager // 底层的 IOManager
+	buf     []byte    // 还没有写入底层文件的数据
+	flushed int64     // 底层文件的大小，缓冲区中的数据从这个位置开始
+	limit   int       // 缓冲区的阈值
+	lock    *sync.RWMutex
+}
+
+// NewBufferedIOManager 初始化带写缓冲的 IO，bufferSize 为缓冲区的阈值
+func NewBufferedIOManager(manager IOManager, bufferSize int) (*BufferedIO, error) {
+	size, err := manager.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &BufferedIO{
+		manager: manager,
+		buf:     make([]byte, 0, bufferSize),
+		flushed: size,
+		limit:   bufferSize,
+		lock:    new(sync.RWMutex),
+	}, nil
+}
+
+func (bio *BufferedIO) Read(b []byte, offset int64) (int, error) {
+	bio.lock.RLock()
+	defer bio.lock.RUnlock()
+
+	var n int
+	// 已经写入底层文件的部分
+	if offset < bio.flushed {
+		end := len(b)
+		if remain := bio.flushed - offset; int64(end) > remain {
+			end = int(remain)
+		}
+		read, err := bio.manager.Read(b[:end], offset)
+		n += read
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if read < end {
+			return n, io.EOF
+		}
+		offset += int64(read)
+	}
+	// 还在缓冲区中的部分
+	if n < len(b) && offset-bio.flushed < int64(len(bio.buf)) {
+		n += copy(b[n:], bio.buf[offset-bio.flushed:])
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (bio *BufferedIO) Write(b []byte) (int, error) {
+	bio.lock.Lock()
+	defer bio.lock.Unlock()
+
+	// 缓冲区放不下，先把缓冲区中的数据写入底层文件
+	if len(bio.buf)+len(b) > bio.limit {
+		if err := bio.flush(); err != nil {
+			return 0, err
+		}
+	}
+	// 超过阈值的数据直接写入底层文件
+	if len(b) >= bio.limit {
+		n, err := bio.manager.Write(b)
+		bio.flushed += int64(n)
+		return n, err
+	}
+	bio.buf = append(bio.buf, b...)
+	return len(b), nil
+}
+
+// Flush 将缓冲区中的数据写入底层文件，不进行持久化
+func (bio *BufferedIO) Flush() error {
+	bio.lock.Lock()
+	defer bio.lock.Unlock()
+	return bio.flush()
+}
+
+// Buffered 缓冲区中还没有写入底层文件的数据大小
+func (bio *BufferedIO) Buffered() int {
+	bio.lock.RLock()
+	defer bio.lock.RUnlock()
+	return len(bio.buf)
+}
+
+// Unwrap 返回底层的 IOManager
+func (bio *BufferedIO) Unwrap() IOManager {
+	return bio.manager
+}
+
+func (bio *BufferedIO) Sync() error {
+	bio.lock.Lock()
+	defer bio.lock.Unlock()
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	return bio.manager.Sync()
+}
+
+func (bio *BufferedIO) Close() error {
+	bio.lock.Lock()
+	defer bio.lock.Unlock()
+	if err := bio.flush(); err != nil {
+		_ = bio.manager.Close()
+		return err
+	}
+	return bio.manager.Close()
+}
+
+func (bio *BufferedIO) Size() (int64, error) {
+	bio.lock.RLock()
+	defer bio.lock.RUnlock()
+	return bio.flushed + int64(len(bio.buf)), nil
+}
+
+func (bio *BufferedIO) Truncate(size int64) error {
+	bio.lock.Lock()
+	defer bio.lock.Unlock()
+	if size < 0 || size > bio.flushed+int64(len(bio.buf)) {
+		return ErrInvalidTruncateSize
+	}
+	if size >= bio.flushed {
+		bio.buf = bio.buf[:size-bio.flushed]
+		return nil
+	}
+	bio.buf = bio.buf[:0]
+	if err := bio.manager.Truncate(size); err != nil {
+		return err
+	}
+	bio.flushed = size
+	return nil
+}
+
+// 将缓冲区中的数据写入底层文件，写入失败时缓冲区中保留未写入的部分
+func (bio *BufferedIO) flush() error {
+	if len(bio.buf) == 0 {
+		return nil
+	}
+	n, err := bio.manager.Write(bio.buf)
+	bio.flushed += int64(n)
+	bio.buf = bio.buf[:copy(bio.buf, bio.buf[n:])]
+	return err
+}
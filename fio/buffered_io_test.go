@@ -0,0 +1,101 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBufferedIO_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "buffered-a.data")
+	defer destroyFile(path)
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	bio, err := NewBufferedIOManager(fio, 16)
+	assert.Nil(t, err)
+
+	_, err = bio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, bio.Buffered())
+
+	// 数据还在缓冲区中，没有写入文件
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size())
+	size, err := bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	// 缓冲区放不下，之前的数据写入文件
+	_, err = bio.Write([]byte("key-c-long"))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, bio.Buffered())
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+
+	// 超过阈值的数据直接写入文件
+	_, err = bio.Write(make([]byte, 20))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, bio.Buffered())
+
+	assert.Nil(t, bio.Close())
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), stat.Size())
+}
+
+func TestBufferedIO_Read(t *testing.T) {
+	path := filepath.Join("/tmp", "buffered-b.data")
+	defer destroyFile(path)
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	bio, err := NewBufferedIOManager(fio, 1024)
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	// 分别读取文件中和缓冲区中的数据
+	b := make([]byte, 5)
+	_, err = bio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	_, err = bio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+
+	// 跨越文件和缓冲区的读取
+	b2 := make([]byte, 6)
+	_, err = bio.Read(b2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("y-akey"), b2)
+
+	n, err := bio.Read(b2, 8)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+
+	// Sync 之后缓冲区中的数据写入文件
+	assert.Nil(t, bio.Sync())
+	assert.Equal(t, 0, bio.Buffered())
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+
+	// 截断缓冲区和文件中的数据
+	_, err = bio.Write([]byte("key-c"))
+	assert.Nil(t, err)
+	assert.Nil(t, bio.Truncate(12))
+	assert.Equal(t, 2, bio.Buffered())
+	assert.Nil(t, bio.Truncate(3))
+	assert.Equal(t, 0, bio.Buffered())
+	assert.Equal(t, ErrInvalidTruncateSize, bio.Truncate(4))
+	assert.Nil(t, bio.Close())
+}
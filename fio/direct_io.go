@@ -0,0 +1,255 @@
+//go:build linux
+
+package fio
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// O_DIRECT 要求读写的内存地址、文件偏移和长度都按块对齐
+	directIOAlignment = 4096
+	// 写缓冲区的大小，写满之后整块写入文件
+	directIOWriteBufferSize = 1024 * 1024
+	// 每次从文件中预读的大小，顺序读取时减少系统调用
+	directIOReadAheadSize = 256 * 1024
+)
+
+// DirectFileIO 使用 O_DIRECT 绕过页缓存的文件 IO，适合 merge 这类大量顺序读写的场景
+// 写入先追加到对齐的缓冲区中，写满之后整块写入文件；Sync 时最后不满一块的数据补 0 之后写入，
+// 下一次写满时覆盖补齐的部分，Close 时将文件截断为实际写入的大小
+type DirectFileIO struct {
+	fd       *os.File
+	writeBuf []byte // 对齐的写缓冲区，起始位置对应文件中的 flushed
+	bufLen   int    // 写缓冲区中数据的长度
+	flushed  int64  // 已经整块写入文件的大小，总是按块对齐
+	dirty    bool   // 写缓冲区中是否有还没有写入文件的数据
+	padded   bool   // 文件中是否有超过实际大小的数据，例如补齐的 0
+	readBuf  []byte // 对齐的预读缓冲区
+	readOff  int64  // 预读缓冲区对应的文件偏移
+	readLen  int    // 预读缓冲区中有效数据的长度
+	lock     *sync.Mutex
+}
+
+// NewDirectIOManager 初始化 Direct IO
+func NewDirectIOManager(fileName string) (*DirectFileIO, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|unix.O_DIRECT, DataFilePerm)
+	if err != nil {
+		// 部分文件系统（例如 tmpfs）不支持 O_DIRECT
+		if errors.Is(err, unix.EINVAL) {
+			return nil, fmt.Errorf("%w: %v", ErrDirectIOUnsupported, err)
+		}
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	dio := &DirectFileIO{
+		fd:       fd,
+		writeBuf: alignedBuffer(directIOWriteBufferSize),
+		readBuf:  alignedBuffer(directIOReadAheadSize),
+		flushed:  alignDown(stat.Size()),
+		lock:     new(sync.Mutex),
+	}
+	// 最后不满一块的数据加载到写缓冲区，后续的写入追加在它之后
+	if err := dio.loadTail(stat.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return dio, nil
+}
+
+func (dio *DirectFileIO) Read(b []byte, offset int64) (int, error) {
+	dio.lock.Lock()
+	defer dio.lock.Unlock()
+
+	size := dio.flushed + int64(dio.bufLen)
+	var n int
+	for n < len(b) && offset < size {
+		var copied int
+		if offset >= dio.flushed {
+			// 还在写缓冲区中的数据
+			copied = copy(b[n:], dio.writeBuf[offset-dio.flushed:dio.bufLen])
+		} else {
+			if offset < dio.readOff || offset >= dio.readOff+int64(dio.readLen) {
+				if err := dio.readAhead(offset); err != nil {
+					return n, err
+				}
+			}
+			end := dio.readLen
+			if limit := dio.flushed - dio.readOff; int64(end) > limit {
+				end = int(limit)
+			}
+			copied = copy(b[n:], dio.readBuf[offset-dio.readOff:end])
+		}
+		n += copied
+		offset += int64(copied)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (dio *DirectFileIO) Write(b []byte) (int, error) {
+	dio.lock.Lock()
+	defer dio.lock.Unlock()
+
+	var n int
+	for n < len(b) {
+		copied := copy(dio.writeBuf[dio.bufLen:], b[n:])
+		dio.bufLen += copied
+		dio.dirty = true
+		n += copied
+		// 写缓冲区满了，整块写入文件
+		if dio.bufLen == len(dio.writeBuf) {
+			if _, err := dio.fd.WriteAt(dio.writeBuf, dio.flushed); err != nil {
+				return n, err
+			}
+			dio.flushed += int64(dio.bufLen)
+			dio.bufLen = 0
+			dio.dirty = false
+			dio.padded = false
+			dio.readLen = 0
+		}
+	}
+	return n, nil
+}
+
+func (dio *DirectFileIO) Sync() error {
+	dio.lock.Lock()
+	defer dio.lock.Unlock()
+	if err := dio.flush(); err != nil {
+		return err
+	}
+	return dio.fd.Sync()
+}
+
+// Close 写入缓冲区中的数据，并将文件截断为实际写入的大小
+func (dio *DirectFileIO) Close() error {
+	dio.lock.Lock()
+	defer dio.lock.Unlock()
+	defer dio.fd.Close()
+	if err := dio.flush(); err != nil {
+		return err
+	}
+	if !dio.padded {
+		return nil
+	}
+	if err := dio.fd.Truncate(dio.flushed + int64(dio.bufLen)); err != nil {
+		return err
+	}
+	return dio.fd.Sync()
+}
+
+func (dio *DirectFileIO) Size() (int64, error) {
+	dio.lock.Lock()
+	defer dio.lock.Unlock()
+	return dio.flushed + int64(dio.bufLen), nil
+}
+
+// Truncate 丢弃 size 之后的数据
+func (dio *DirectFileIO) Truncate(size int64) error {
+	dio.lock.Lock()
+	defer dio.lock.Unlock()
+	if size < 0 || size > dio.flushed+int64(dio.bufLen) {
+		return ErrInvalidTruncateSize
+	}
+	dio.readLen = 0
+	if size >= dio.flushed {
+		// 被丢弃的数据可能已经写入了文件，关闭时需要截断
+		dio.padded = dio.padded || size < dio.flushed+int64(dio.bufLen)
+		dio.bufLen = int(size - dio.flushed)
+		return nil
+	}
+	if err := dio.fd.Truncate(size); err != nil {
+		return err
+	}
+	dio.flushed = alignDown(size)
+	dio.dirty, dio.padded = false, false
+	return dio.loadTail(size)
+}
+
+// 将写缓冲区中的数据补齐到整块之后写入文件，整块的部分从缓冲区中移除
+func (dio *DirectFileIO) flush() error {
+	if !dio.dirty {
+		return nil
+	}
+	padded := alignUp(int64(dio.bufLen))
+	for i := dio.bufLen; i < int(padded); i++ {
+		dio.writeBuf[i] = 0
+	}
+	if _, err := dio.fd.WriteAt(dio.writeBuf[:padded], dio.flushed); err != nil {
+		return err
+	}
+	if int(padded) > dio.bufLen {
+		dio.padded = true
+	}
+	full := int(alignDown(int64(dio.bufLen)))
+	copy(dio.writeBuf, dio.writeBuf[full:dio.bufLen])
+	dio.flushed += int64(full)
+	dio.bufLen -= full
+	dio.dirty = false
+	dio.readLen = 0
+	return nil
+}
+
+// 从 offset 所在的块开始预读，不超过已经写入文件的部分
+func (dio *DirectFileIO) readAhead(offset int64) error {
+	dio.readOff = alignDown(offset)
+	length := int64(len(dio.readBuf))
+	if remain := dio.flushed - dio.readOff; remain < length {
+		length = remain
+	}
+	n, err := dio.fd.ReadAt(dio.readBuf[:length], dio.readOff)
+	dio.readLen = n
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+// 将 flushed 到 size 之间的数据加载到写缓冲区
+func (dio *DirectFileIO) loadTail(size int64) error {
+	dio.bufLen = int(size - dio.flushed)
+	if dio.bufLen == 0 {
+		return nil
+	}
+	n, err := dio.fd.ReadAt(dio.writeBuf[:directIOAlignment], dio.flushed)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n < dio.bufLen {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// 分配起始地址按块对齐的内存
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+	if offset != 0 {
+		offset = directIOAlignment - offset
+	}
+	return buf[offset : offset+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directIOAlignment - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + directIOAlignment - 1)
+}
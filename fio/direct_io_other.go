@@ -0,0 +1,8 @@
+//go:build !linux
+
+package fio
+
+// NewDirectIOManager 当前平台不支持 O_DIRECT
+func NewDirectIOManager(fileName string) (IOManager, error) {
+	return nil, ErrDirectIOUnsupported
+}
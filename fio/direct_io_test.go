@@ -0,0 +1,129 @@
+//go:build linux
+
+package fio
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openDirectIO(t *testing.T, path string) *DirectFileIO {
+	dio, err := NewDirectIOManager(path)
+	if errors.Is(err, ErrDirectIOUnsupported) {
+		t.Skip(err)
+	}
+	assert.Nil(t, err)
+	return dio
+}
+
+func TestDirectFileIO_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "direct-a.data")
+	defer destroyFile(path)
+	dio := openDirectIO(t, path)
+
+	_, err := dio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	// 超过写缓冲区的大小，前面的数据整块写入文件
+	_, err = dio.Write(make([]byte, directIOWriteBufferSize))
+	assert.Nil(t, err)
+	_, err = dio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(directIOWriteBufferSize+10), size)
+
+	// 分别读取文件中和写缓冲区中的数据
+	b := make([]byte, 5)
+	_, err = dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	_, err = dio.Read(b, size-5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+
+	// 跨越文件和写缓冲区的读取
+	b2 := make([]byte, 20)
+	n, err := dio.Read(b2, size-20)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, n)
+	assert.Equal(t, []byte("key-b"), b2[15:])
+
+	n, err = dio.Read(b2, size-2)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, dio.Close())
+}
+
+func TestDirectFileIO_Sync(t *testing.T) {
+	path := filepath.Join("/tmp", "direct-b.data")
+	defer destroyFile(path)
+	dio := openDirectIO(t, path)
+
+	_, err := dio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Sync())
+
+	// 不满一块的数据补齐之后写入文件
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(directIOAlignment), stat.Size())
+
+	// Sync 之后继续追加，覆盖补齐的部分
+	_, err = dio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Sync())
+	assert.Nil(t, dio.Close())
+
+	// 关闭之后文件截断为实际写入的大小
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-akey-b"), b)
+	assert.Nil(t, fio.Close())
+}
+
+func TestDirectFileIO_Reopen(t *testing.T) {
+	path := filepath.Join("/tmp", "direct-c.data")
+	defer destroyFile(path)
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	_, err = fio.Write(make([]byte, directIOAlignment+5))
+	assert.Nil(t, err)
+	assert.Nil(t, fio.Close())
+
+	// 打开已有的文件，从文件末尾继续写入
+	dio := openDirectIO(t, path)
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(directIOAlignment+5), size)
+	_, err = dio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	b := make([]byte, 5)
+	_, err = dio.Read(b, size)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+
+	// 截断到已经写入文件的部分之前
+	assert.Equal(t, ErrInvalidTruncateSize, dio.Truncate(size+10))
+	assert.Nil(t, dio.Truncate(3))
+	_, err = dio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Close())
+
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), stat.Size())
+}
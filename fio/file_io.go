@@ -3,19 +3,27 @@ package fio
 import "os"
 
 type FileIO struct {
-	fd *os.File // 系统文件描述符
+	fd           *os.File // 系统文件描述符
+	size         int64    // 已经写入的数据的末尾，预分配之后文件的实际大小会大于此值
+	preallocated int64    // 预分配的大小，为 0 表示没有预分配
 }
 
 func NewFileIOManager(fileName string) (*FileIO, error) {
 	fd, err := os.OpenFile(
 		fileName,
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
+		os.O_CREATE|os.O_RDWR,
 		DataFilePerm)
 	if err != nil {
 		return nil, err
 	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
 	return &FileIO{
-		fd: fd,
+		fd:   fd,
+		size: stat.Size(),
 	}, nil
 }
 
@@ -23,22 +31,59 @@ func (f *FileIO) Read(bytes []byte, offset int64) (int, error) {
 	return f.fd.ReadAt(bytes, offset)
 }
 
+// Write 从已经写入的数据的末尾开始写入，预分配的空间会被依次覆盖
 func (f *FileIO) Write(bytes []byte) (int, error) {
-	return f.fd.Write(bytes)
+	n, err := f.fd.WriteAt(bytes, f.size)
+	f.size += int64(n)
+	return n, err
 }
 
+// Sync 写入没有超出预分配的空间时文件大小不会变化，只需要持久化数据
 func (f *FileIO) Sync() error {
+	if f.preallocated > 0 && f.size <= f.preallocated {
+		return datasync(f.fd)
+	}
 	return f.fd.Sync()
 }
 
+// Close 关闭文件，没有用到的预分配空间会被截断
 func (f *FileIO) Close() error {
+	if f.preallocated > 0 {
+		if err := f.fd.Truncate(f.size); err != nil {
+			_ = f.fd.Close()
+			return err
+		}
+	}
 	return f.fd.Close()
 }
 
+// Size 已经写入的数据的大小，不包含预分配的空间
 func (f *FileIO) Size() (int64, error) {
-	stat, err := f.fd.Stat()
+	return f.size, nil
+}
+
+// Truncate 截断文件，之后的写入从新的末尾开始，预分配的空间也会被释放
+func (f *FileIO) Truncate(size int64) error {
+	if err := f.fd.Truncate(size); err != nil {
+		return err
+	}
+	f.size = size
+	f.preallocated = 0
+	return nil
+}
+
+// Preallocate 为文件预分配 size 大小的空间，预分配的区域全部为 0
+// 当前平台或者文件系统不支持时不做处理
+func (f *FileIO) Preallocate(size int64) error {
+	if size <= f.size || size <= f.preallocated {
+		return nil
+	}
+	ok, err := fallocate(f.fd, size)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if ok {
+		f.preallocated = size
 	}
-	return stat.Size(), nil
+	return nil
 }
@@ -88,3 +88,38 @@ func TestFileIO_Close(t *testing.T) {
 	err = file.Close()
 	assert.Nil(t, err)
 }
+
+func TestFileIO_Preallocate(t *testing.T) {
+	path := filepath.Join("/tmp", "prealloc.data")
+	file, err := NewFileIOManager(path)
+	defer destroyFile(path)
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Preallocate(4096))
+	if file.preallocated == 0 {
+		t.Skip("preallocation is not supported")
+	}
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4096), stat.Size())
+
+	// 写入从已经写入的数据的末尾开始，Size 不包含预分配的空间
+	_, err = file.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	size, err := file.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+	b := make([]byte, 10)
+	_, err = file.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-akey-b"), b)
+	assert.Nil(t, file.Sync())
+
+	// 关闭时截断没有用到的空间
+	assert.Nil(t, file.Close())
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+}
@@ -0,0 +1,106 @@
+package fio
+
+import (
+	"bitcask-go/utils"
+	"context"
+	"github.com/gofrs/flock"
+	"io/fs"
+	"os"
+)
+
+// FileSystem 文件系统抽象，数据目录和 merge 目录中的文件操作都通过它进行
+// 默认使用操作系统的文件系统 OSFileSystem，也可以使用完全在内存中的 MemFileSystem
+type FileSystem interface {
+	// OpenFile 打开文件，不存在时创建，ioType 为文件使用的 IO 类型
+	OpenFile(name string, ioType FileIOType) (IOManager, error)
+	// Stat 获取文件或者目录的信息，不存在时返回的错误满足 os.IsNotExist
+	Stat(name string) (fs.FileInfo, error)
+	// ReadDir 按文件名排序列出目录中的文件和子目录
+	ReadDir(dirPath string) ([]fs.DirEntry, error)
+	// MkdirAll 创建目录，包括所有不存在的上级目录
+	MkdirAll(dirPath string) error
+	// Remove 删除文件或者空目录
+	Remove(name string) error
+	// RemoveAll 删除文件或者目录及其中的所有文件，不存在时不返回错误
+	RemoveAll(path string) error
+	// Rename 重命名文件
+	Rename(oldPath, newPath string) error
+	// SyncDir 持久化目录，保证目录中文件的创建、重命名和删除在掉电之后不会丢失
+	SyncDir(dirPath string) error
+	// TryLock 尝试对文件加锁，已经被其他实例锁住时返回 false
+	TryLock(name string) (FileLock, bool, error)
+	// DirSize 获取目录中所有文件的大小
+	DirSize(dirPath string) (int64, error)
+	// AvailableSize 获取目录所在位置剩余的可用空间
+	AvailableSize(dirPath string) (uint64, error)
+	// CopyDir 拷贝目录，跳过文件名匹配 exclude 的文件，ctx 被取消时停止拷贝
+	CopyDir(ctx context.Context, src, dest string, exclude []string) error
+}
+
+// FileLock 文件锁
+type FileLock interface {
+	Unlock() error
+}
+
+// OSFileSystem 操作系统的文件系统
+var OSFileSystem FileSystem = osFileSystem{}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, ioType FileIOType) (IOManager, error) {
+	return NewIOManager(name, ioType)
+}
+
+func (osFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) ReadDir(dirPath string) ([]fs.DirEntry, error) {
+	return os.ReadDir(dirPath)
+}
+
+func (osFileSystem) MkdirAll(dirPath string) error {
+	return os.MkdirAll(dirPath, os.ModePerm)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osFileSystem) SyncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+func (osFileSystem) TryLock(name string) (FileLock, bool, error) {
+	fileLock := flock.New(name)
+	hold, err := fileLock.TryLock()
+	return fileLock, hold, err
+}
+
+func (osFileSystem) DirSize(dirPath string) (int64, error) {
+	return utils.DirSize(dirPath)
+}
+
+func (osFileSystem) AvailableSize(dirPath string) (uint64, error) {
+	return utils.DirAvailableSize(dirPath)
+}
+
+func (osFileSystem) CopyDir(ctx context.Context, src, dest string, exclude []string) error {
+	return utils.CopyDirContext(ctx, src, dest, exclude)
+}
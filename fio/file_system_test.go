@@ -0,0 +1,23 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOSFileSystem_AvailableSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fs-available-size")
+	defer destroyFile(dir)
+	wd, _ := os.Getwd()
+	assert.NotEqual(t, wd, dir)
+
+	size, err := OSFileSystem.AvailableSize(dir)
+	assert.Nil(t, err)
+	assert.True(t, size > 0)
+
+	// 统计的是数据目录所在的磁盘，目录不存在时返回错误
+	_, err = OSFileSystem.AvailableSize(filepath.Join(dir, "not-exist"))
+	assert.NotNil(t, err)
+}
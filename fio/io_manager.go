@@ -1,12 +1,23 @@
 package fio
 
+import "errors"
+
 const DataFilePerm = 0644
 
+var (
+	ErrInvalidTruncateSize = errors.New("truncate size exceeds the file size")
+	ErrDirectIOUnsupported = errors.New("direct io is not supported on this platform or file system")
+)
+
 type FileIOType = byte
 
 const (
 	StandardFIO FileIOType = iota
 	MemoryMap
+	// WritableMemoryMap 可写的内存文件映射，用于活跃文件
+	WritableMemoryMap
+	// DirectIO 使用 O_DIRECT 绕过页缓存
+	DirectIO
 )
 
 // IOManager 抽象 IO 管理接口，可以接入不同的 IO 类型， 目前支持标准文件 IO
@@ -21,6 +32,14 @@ type IOManager interface {
 	Close() error
 	// Size 获取文件的大小
 	Size() (int64, error)
+	// Truncate 截断文件，丢弃 size 之后的数据
+	Truncate(size int64) error
+}
+
+// Preallocator 支持预分配磁盘空间的 IOManager
+// 预分配之后 Size 仍然返回已经写入的数据的大小，写入从已经写入的数据的末尾开始
+type Preallocator interface {
+	Preallocate(size int64) error
 }
 
 // 初始化IOManager，目前只支持 FileIO
@@ -31,6 +50,10 @@ func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
 		return NewFileIOManager(fileName)
 	case MemoryMap:
 		return NewMMapIOManager(fileName)
+	case WritableMemoryMap:
+		return NewWritableMMapIOManager(fileName)
+	case DirectIO:
+		return NewDirectIOManager(fileName)
 	default:
 		panic("unsupported io type")
 	}
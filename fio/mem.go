@@ -0,0 +1,387 @@
+package fio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errMemIsDir    = errors.New("is a directory")
+	errMemNotDir   = errors.New("not a directory")
+	errMemNotEmpty = errors.New("directory not empty")
+)
+
+// MemFileSystem 完全在内存中的文件系统，不会访问磁盘
+// 同一个 MemFileSystem 中的文件在关闭之后仍然保留，可以被重新打开，
+// 所有的 IO 类型都使用内存文件
+type MemFileSystem struct {
+	files map[string]*memFileData // 文件路径 -> 文件内容
+	dirs  map[string]bool         // 已经创建的目录
+	locks map[string]bool         // 已经加锁的文件
+	lock  *sync.RWMutex
+}
+
+// NewMemFileSystem 初始化内存文件系统
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		files: make(map[string]*memFileData),
+		dirs:  map[string]bool{"/": true},
+		locks: make(map[string]bool),
+		lock:  new(sync.RWMutex),
+	}
+}
+
+// 内存文件的内容，同一个文件的多个 MemFile 共享
+type memFileData struct {
+	data    []byte
+	modTime time.Time
+	lock    *sync.RWMutex
+}
+
+func (mfs *MemFileSystem) OpenFile(name string, ioType FileIOType) (IOManager, error) {
+	name = memPath(name)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if !mfs.dirs[path.Dir(name)] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if mfs.dirs[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errMemIsDir}
+	}
+	file, ok := mfs.files[name]
+	if !ok {
+		file = &memFileData{modTime: time.Now(), lock: new(sync.RWMutex)}
+		mfs.files[name] = file
+	}
+	return &MemFile{file: file}, nil
+}
+
+func (mfs *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	name = memPath(name)
+	mfs.lock.RLock()
+	defer mfs.lock.RUnlock()
+	if mfs.dirs[name] {
+		return &memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	if file, ok := mfs.files[name]; ok {
+		return file.info(path.Base(name)), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemFileSystem) ReadDir(dirPath string) ([]fs.DirEntry, error) {
+	dirPath = memPath(dirPath)
+	mfs.lock.RLock()
+	defer mfs.lock.RUnlock()
+	if !mfs.dirs[dirPath] {
+		return nil, &fs.PathError{Op: "readdir", Path: dirPath, Err: fs.ErrNotExist}
+	}
+	var entries []fs.DirEntry
+	for name := range mfs.dirs {
+		if name != dirPath && path.Dir(name) == dirPath {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{name: path.Base(name), dir: true}))
+		}
+	}
+	for name, file := range mfs.files {
+		if path.Dir(name) == dirPath {
+			entries = append(entries, fs.FileInfoToDirEntry(file.info(path.Base(name))))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (mfs *MemFileSystem) MkdirAll(dirPath string) error {
+	dirPath = memPath(dirPath)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	for p := dirPath; !mfs.dirs[p]; p = path.Dir(p) {
+		if _, ok := mfs.files[p]; ok {
+			return &fs.PathError{Op: "mkdir", Path: p, Err: errMemNotDir}
+		}
+		mfs.dirs[p] = true
+	}
+	return nil
+}
+
+func (mfs *MemFileSystem) Remove(name string) error {
+	name = memPath(name)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if _, ok := mfs.files[name]; ok {
+		delete(mfs.files, name)
+		return nil
+	}
+	if !mfs.dirs[name] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	prefix := name + "/"
+	for p := range mfs.dirs {
+		if strings.HasPrefix(p, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errMemNotEmpty}
+		}
+	}
+	for p := range mfs.files {
+		if strings.HasPrefix(p, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errMemNotEmpty}
+		}
+	}
+	delete(mfs.dirs, name)
+	return nil
+}
+
+func (mfs *MemFileSystem) RemoveAll(p string) error {
+	p = memPath(p)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	prefix := p + "/"
+	for name := range mfs.files {
+		if name == p || strings.HasPrefix(name, prefix) {
+			delete(mfs.files, name)
+		}
+	}
+	for name := range mfs.dirs {
+		if name != "/" && (name == p || strings.HasPrefix(name, prefix)) {
+			delete(mfs.dirs, name)
+		}
+	}
+	return nil
+}
+
+func (mfs *MemFileSystem) Rename(oldPath, newPath string) error {
+	oldPath, newPath = memPath(oldPath), memPath(newPath)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	file, ok := mfs.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if !mfs.dirs[path.Dir(newPath)] {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	delete(mfs.files, oldPath)
+	mfs.files[newPath] = file
+	return nil
+}
+
+func (mfs *MemFileSystem) TryLock(name string) (FileLock, bool, error) {
+	name = memPath(name)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if mfs.locks[name] {
+		return nil, false, nil
+	}
+	mfs.locks[name] = true
+	return &memFileLock{mfs: mfs, name: name}, true, nil
+}
+
+func (mfs *MemFileSystem) DirSize(dirPath string) (int64, error) {
+	dirPath = memPath(dirPath)
+	mfs.lock.RLock()
+	defer mfs.lock.RUnlock()
+	if !mfs.dirs[dirPath] {
+		return 0, &fs.PathError{Op: "lstat", Path: dirPath, Err: fs.ErrNotExist}
+	}
+	var size int64
+	prefix := dirPath + "/"
+	for name, file := range mfs.files {
+		if strings.HasPrefix(name, prefix) {
+			size += file.size()
+		}
+	}
+	return size, nil
+}
+
+// SyncDir 内存文件系统的修改立即生效，只检查目录是否存在
+func (mfs *MemFileSystem) SyncDir(dirPath string) error {
+	dirPath = memPath(dirPath)
+	mfs.lock.RLock()
+	defer mfs.lock.RUnlock()
+	if !mfs.dirs[dirPath] {
+		return &fs.PathError{Op: "sync", Path: dirPath, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// AvailableSize 内存文件系统不限制大小
+func (mfs *MemFileSystem) AvailableSize(dirPath string) (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+func (mfs *MemFileSystem) CopyDir(ctx context.Context, src, dest string, exclude []string) error {
+	src, dest = memPath(src), memPath(dest)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if !mfs.dirs[src] {
+		return &fs.PathError{Op: "lstat", Path: src, Err: fs.ErrNotExist}
+	}
+	mfs.mkdirAll(dest)
+	prefix := src + "/"
+	for name := range mfs.dirs {
+		if strings.HasPrefix(name, prefix) && !memExcluded(name, exclude) {
+			mfs.mkdirAll(path.Join(dest, strings.TrimPrefix(name, prefix)))
+		}
+	}
+	for name, file := range mfs.files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(name, prefix) || memExcluded(name, exclude) {
+			continue
+		}
+		destName := path.Join(dest, strings.TrimPrefix(name, prefix))
+		if !mfs.dirs[path.Dir(destName)] {
+			// 所在的目录被排除了
+			continue
+		}
+		mfs.files[destName] = file.clone()
+	}
+	return nil
+}
+
+func (mfs *MemFileSystem) mkdirAll(dirPath string) {
+	for p := dirPath; !mfs.dirs[p]; p = path.Dir(p) {
+		mfs.dirs[p] = true
+	}
+}
+
+func memExcluded(name string, exclude []string) bool {
+	for _, e := range exclude {
+		if matched, _ := path.Match(e, path.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// 内存文件系统中统一使用以 / 开头的路径
+func memPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func (f *memFileData) size() int64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return int64(len(f.data))
+}
+
+func (f *memFileData) info(name string) *memFileInfo {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return &memFileInfo{name: name, size: int64(len(f.data)), modTime: f.modTime}
+}
+
+func (f *memFileData) clone() *memFileData {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	data := make([]byte, len(f.data))
+	copy(data, f.data)
+	return &memFileData{data: data, modTime: f.modTime, lock: new(sync.RWMutex)}
+}
+
+// MemFile 内存文件的 IOManager
+type MemFile struct {
+	file *memFileData
+}
+
+func (mf *MemFile) Read(b []byte, offset int64) (int, error) {
+	mf.file.lock.RLock()
+	defer mf.file.lock.RUnlock()
+	if offset >= int64(len(mf.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mf.file.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mf *MemFile) Write(b []byte) (int, error) {
+	mf.file.lock.Lock()
+	defer mf.file.lock.Unlock()
+	mf.file.data = append(mf.file.data, b...)
+	mf.file.modTime = time.Now()
+	return len(b), nil
+}
+
+func (mf *MemFile) Sync() error {
+	return nil
+}
+
+func (mf *MemFile) Close() error {
+	return nil
+}
+
+func (mf *MemFile) Size() (int64, error) {
+	return mf.file.size(), nil
+}
+
+func (mf *MemFile) Truncate(size int64) error {
+	mf.file.lock.Lock()
+	defer mf.file.lock.Unlock()
+	if size < 0 || size > int64(len(mf.file.data)) {
+		return ErrInvalidTruncateSize
+	}
+	mf.file.data = mf.file.data[:size]
+	mf.file.modTime = time.Now()
+	return nil
+}
+
+type memFileLock struct {
+	mfs  *MemFileSystem
+	name string
+}
+
+func (l *memFileLock) Unlock() error {
+	l.mfs.lock.Lock()
+	defer l.mfs.lock.Unlock()
+	delete(l.mfs.locks, l.name)
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *memFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *memFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | os.ModePerm
+	}
+	return DataFilePerm
+}
+
+func (fi *memFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *memFileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *memFileInfo) Sys() any {
+	return nil
+}
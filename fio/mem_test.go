@@ -0,0 +1,122 @@
+package fio
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemFileSystem_OpenFile(t *testing.T) {
+	mfs := NewMemFileSystem()
+
+	// 目录不存在
+	_, err := mfs.OpenFile("/a/b/0.data", StandardFIO)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, mfs.MkdirAll("/a/b"))
+	file, err := mfs.OpenFile("/a/b/0.data", StandardFIO)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	// 关闭之后重新打开，数据仍然存在
+	file2, err := mfs.OpenFile("/a/b/0.data", MemoryMap)
+	assert.Nil(t, err)
+	size, err := file2.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	b := make([]byte, 6)
+	n, err := file2.Read(b, 5)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("key-b"), b[:n])
+
+	assert.Nil(t, file2.Truncate(5))
+	stat, err := mfs.Stat("/a/b/0.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stat.Size())
+	assert.False(t, stat.IsDir())
+}
+
+func TestMemFileSystem_Dir(t *testing.T) {
+	mfs := NewMemFileSystem()
+	assert.Nil(t, mfs.MkdirAll("/a/sub"))
+	for _, name := range []string{"/a/2.data", "/a/1.data", "/a/flock", "/a/sub/3.data"} {
+		file, err := mfs.OpenFile(name, StandardFIO)
+		assert.Nil(t, err)
+		_, err = file.Write([]byte("value"))
+		assert.Nil(t, err)
+	}
+
+	entries, err := mfs.ReadDir("/a")
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"1.data", "2.data", "flock", "sub"}, names)
+
+	size, err := mfs.DirSize("/a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), size)
+
+	// 拷贝目录，拷贝之后的文件互不影响
+	assert.Nil(t, mfs.CopyDir(context.Background(), "/a", "/backup", []string{"flock"}))
+	_, err = mfs.Stat("/backup/flock")
+	assert.True(t, os.IsNotExist(err))
+	_, err = mfs.Stat("/backup/sub/3.data")
+	assert.Nil(t, err)
+	file, err := mfs.OpenFile("/backup/1.data", StandardFIO)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("more"))
+	assert.Nil(t, err)
+	stat, err := mfs.Stat("/a/1.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stat.Size())
+
+	// 重命名和删除
+	assert.Nil(t, mfs.Rename("/a/sub/3.data", "/a/3.data"))
+	assert.NotNil(t, mfs.Remove("/a"))
+	assert.Nil(t, mfs.Remove("/a/sub"))
+	assert.Nil(t, mfs.RemoveAll("/a"))
+	_, err = mfs.Stat("/a/3.data")
+	assert.True(t, os.IsNotExist(err))
+	_, err = mfs.ReadDir("/a")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemFileSystem_TryLock(t *testing.T) {
+	mfs := NewMemFileSystem()
+	lock, hold, err := mfs.TryLock("/a/flock")
+	assert.Nil(t, err)
+	assert.True(t, hold)
+
+	_, hold, err = mfs.TryLock("/a/flock")
+	assert.Nil(t, err)
+	assert.False(t, hold)
+
+	assert.Nil(t, lock.Unlock())
+	_, hold, err = mfs.TryLock("/a/flock")
+	assert.Nil(t, err)
+	assert.True(t, hold)
+}
+
+func TestFileSystem_SyncDir(t *testing.T) {
+	mfs := NewMemFileSystem()
+	assert.True(t, os.IsNotExist(mfs.SyncDir("/a")))
+	assert.Nil(t, mfs.MkdirAll("/a"))
+	assert.Nil(t, mfs.SyncDir("/a"))
+
+	dir, _ := os.MkdirTemp("", "bitcask-go-sync-dir")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	assert.Nil(t, OSFileSystem.SyncDir(dir))
+	assert.True(t, os.IsNotExist(OSFileSystem.SyncDir(dir+"-missing")))
+}
@@ -1,11 +1,14 @@
 package fio
 
 import (
+	"errors"
 	"golang.org/x/exp/mmap"
 	"os"
 )
 
-// MMap IO 内存文件映射
+var ErrReadOnlyMMap = errors.New("the mmap io manager is read only")
+
+// MMap IO 内存文件映射，只读，仅用于启动时加载数据，可写的映射见 WritableMMap
 type MMap struct {
 	readerAt *mmap.ReaderAt
 }
@@ -28,11 +31,11 @@ func (M *MMap) Read(bytes []byte, i int64) (int, error) {
 }
 
 func (M *MMap) Write(bytes []byte) (int, error) {
-	panic("implement me")
+	return 0, ErrReadOnlyMMap
 }
 
 func (M *MMap) Sync() error {
-	panic("implement me")
+	return ErrReadOnlyMMap
 }
 
 func (M *MMap) Close() error {
@@ -42,3 +45,7 @@ func (M *MMap) Close() error {
 func (M *MMap) Size() (int64, error) {
 	return int64(M.readerAt.Len()), nil
 }
+
+func (M *MMap) Truncate(size int64) error {
+	return ErrReadOnlyMMap
+}
@@ -0,0 +1,206 @@
+//go:build unix
+
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync"
+)
+
+// 可写内存映射的初始大小，写满之后按两倍扩容，可以通过 Preallocate 调整
+const writableMMapInitialSize = 8 * 1024 * 1024
+
+// WritableMMap 可读写的内存文件映射
+// 文件会被预先扩展到映射的大小并分配磁盘空间，写入直接拷贝到映射的内存中，Sync 时通过 msync 持久化，
+// Close 时将文件截断为实际写入的大小；进程崩溃时文件尾部会残留全 0 的区域，读取时会被当作文件末尾
+type WritableMMap struct {
+	fd      *os.File
+	data    []byte // 映射的内存区域
+	size    int64  // 实际写入的数据大小
+	resized bool   // 上次 Sync 之后文件的大小是否发生了变化
+	lock    *sync.RWMutex
+}
+
+// NewWritableMMapIOManager 初始化可写的 MMap
+func NewWritableMMapIOManager(fileName string) (*WritableMMap, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	wm := &WritableMMap{
+		fd:   fd,
+		size: stat.Size(),
+		lock: new(sync.RWMutex),
+	}
+	capacity := int64(writableMMapInitialSize)
+	for capacity < wm.size {
+		capacity *= 2
+	}
+	if err := wm.remap(capacity); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return wm, nil
+}
+
+// 将文件调整到 capacity 并重新映射
+// 扩容时先分配磁盘空间，磁盘写满时返回错误，否则写入稀疏文件映射的内存时进程会收到 SIGBUS
+func (wm *WritableMMap) remap(capacity int64) error {
+	oldCapacity := int64(len(wm.data))
+	if capacity > oldCapacity {
+		if err := wm.reserve(capacity); err != nil {
+			return err
+		}
+	}
+	if wm.data != nil {
+		if err := unix.Munmap(wm.data); err != nil {
+			return err
+		}
+		wm.data = nil
+	}
+	if capacity < oldCapacity {
+		if err := wm.fd.Truncate(capacity); err != nil {
+			return err
+		}
+	}
+	data, err := unix.Mmap(int(wm.fd.Fd()), 0, int(capacity), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	wm.data = data
+	wm.resized = true
+	return nil
+}
+
+// 为映射的空间分配磁盘空间，文件系统不支持预分配时只扩展文件大小
+func (wm *WritableMMap) reserve(capacity int64) error {
+	ok, err := fallocate(wm.fd, capacity)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return wm.fd.Truncate(capacity)
+	}
+	return nil
+}
+
+// Preallocate 将映射的大小调整为 size，不会小于已经写入的数据，用于把映射限制在数据文件的大小之内
+func (wm *WritableMMap) Preallocate(size int64) error {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	if wm.data == nil {
+		return os.ErrClosed
+	}
+	if size < wm.size {
+		size = wm.size
+	}
+	if size == 0 || size == int64(len(wm.data)) {
+		return nil
+	}
+	return wm.remap(size)
+}
+
+func (wm *WritableMMap) Read(b []byte, offset int64) (int, error) {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+	if offset >= wm.size {
+		return 0, io.EOF
+	}
+	n := copy(b, wm.data[offset:wm.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (wm *WritableMMap) Write(b []byte) (int, error) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	if wm.data == nil {
+		return 0, os.ErrClosed
+	}
+	// 映射的空间不足，扩容之后重新映射
+	if end := wm.size + int64(len(b)); end > int64(len(wm.data)) {
+		capacity := int64(len(wm.data)) * 2
+		for capacity < end {
+			capacity *= 2
+		}
+		if err := wm.remap(capacity); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(wm.data[wm.size:], b)
+	wm.size += int64(n)
+	return n, nil
+}
+
+func (wm *WritableMMap) Sync() error {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	if wm.data == nil {
+		return os.ErrClosed
+	}
+	if err := unix.Msync(wm.data[:wm.size], unix.MS_SYNC); err != nil {
+		return err
+	}
+	// 文件大小属于元数据，msync 不保证持久化
+	if wm.resized {
+		if err := wm.fd.Sync(); err != nil {
+			return err
+		}
+		wm.resized = false
+	}
+	return nil
+}
+
+// Close 持久化数据并解除映射，文件截断为实际写入的大小
+func (wm *WritableMMap) Close() error {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	if wm.data == nil {
+		return os.ErrClosed
+	}
+	defer wm.fd.Close()
+	if err := unix.Msync(wm.data[:wm.size], unix.MS_SYNC); err != nil {
+		return err
+	}
+	if err := unix.Munmap(wm.data); err != nil {
+		return err
+	}
+	wm.data = nil
+	if err := wm.fd.Truncate(wm.size); err != nil {
+		return err
+	}
+	return wm.fd.Sync()
+}
+
+// Size 实际写入的数据大小，不包括映射中预留的空间
+func (wm *WritableMMap) Size() (int64, error) {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+	return wm.size, nil
+}
+
+// Truncate 丢弃 size 之后的数据，被丢弃的区域清零，之后的写入从 size 处开始
+func (wm *WritableMMap) Truncate(size int64) error {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	if wm.data == nil {
+		return os.ErrClosed
+	}
+	if size < 0 || size > wm.size {
+		return ErrInvalidTruncateSize
+	}
+	for i := size; i < wm.size; i++ {
+		wm.data[i] = 0
+	}
+	wm.size = size
+	return nil
+}
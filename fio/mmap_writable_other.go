@@ -0,0 +1,12 @@
+//go:build !unix
+
+package fio
+
+import "errors"
+
+var ErrWritableMMapUnsupported = errors.New("writable mmap is not supported on this platform")
+
+// NewWritableMMapIOManager 当前平台不支持可写的 MMap
+func NewWritableMMapIOManager(fileName string) (IOManager, error) {
+	return nil, ErrWritableMMapUnsupported
+}
@@ -0,0 +1,163 @@
+//go:build unix
+
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWritableMMap_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w-a.data")
+	defer destroyFile(path)
+
+	wm, err := NewWritableMMapIOManager(path)
+	assert.Nil(t, err)
+
+	n, err := wm.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	n, err = wm.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	size, err := wm.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	// 文件被预先扩展到映射的大小
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(writableMMapInitialSize), stat.Size())
+
+	b := make([]byte, 5)
+	n, err = wm.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+
+	// 不能读取到写入位置之后的数据
+	n, err = wm.Read(b, 8)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, wm.Sync())
+}
+
+func TestWritableMMap_Grow(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w-b.data")
+	defer destroyFile(path)
+
+	wm, err := NewWritableMMapIOManager(path)
+	assert.Nil(t, err)
+
+	// 超过初始映射的大小，重新映射之后之前的数据仍然可读
+	_, err = wm.Write([]byte("head"))
+	assert.Nil(t, err)
+	_, err = wm.Write(make([]byte, writableMMapInitialSize))
+	assert.Nil(t, err)
+	_, err = wm.Write([]byte("tail"))
+	assert.Nil(t, err)
+
+	size, err := wm.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(writableMMapInitialSize+8), size)
+
+	b := make([]byte, 4)
+	_, err = wm.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("head"), b)
+	_, err = wm.Read(b, size-4)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("tail"), b)
+	assert.Nil(t, wm.Close())
+}
+
+func TestWritableMMap_Close(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w-c.data")
+	defer destroyFile(path)
+
+	wm, err := NewWritableMMapIOManager(path)
+	assert.Nil(t, err)
+	_, err = wm.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, wm.Close())
+
+	// 关闭之后文件截断为实际写入的大小
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stat.Size())
+
+	// 重新打开之后从文件末尾继续写入
+	wm2, err := NewWritableMMapIOManager(path)
+	assert.Nil(t, err)
+	_, err = wm2.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, wm2.Close())
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-akey-b"), b)
+	assert.Nil(t, fio.Close())
+}
+
+func TestWritableMMap_Truncate(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w-d.data")
+	defer destroyFile(path)
+
+	wm, err := NewWritableMMapIOManager(path)
+	assert.Nil(t, err)
+	_, err = wm.Write([]byte("key-akey-b"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrInvalidTruncateSize, wm.Truncate(20))
+	assert.Nil(t, wm.Truncate(5))
+	_, err = wm.Write([]byte("key-c"))
+	assert.Nil(t, err)
+
+	b := make([]byte, 10)
+	_, err = wm.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-akey-c"), b)
+	assert.Nil(t, wm.Close())
+}
+
+func TestWritableMMap_Preallocate(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w-e.data")
+	defer destroyFile(path)
+
+	wm, err := NewWritableMMapIOManager(path)
+	assert.Nil(t, err)
+	_, err = wm.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	// 映射缩小到指定的大小，文件随之截断
+	assert.Nil(t, wm.Preallocate(64*1024))
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(64*1024), stat.Size())
+
+	// 不会小于已经写入的数据
+	assert.Nil(t, wm.Preallocate(1))
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stat.Size())
+
+	// 超出之后按两倍扩容
+	_, err = wm.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+
+	b := make([]byte, 10)
+	_, err = wm.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-akey-b"), b)
+	assert.Nil(t, wm.Close())
+}
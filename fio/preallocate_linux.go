@@ -0,0 +1,23 @@
+//go:build linux
+
+package fio
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// 使用 fallocate 分配磁盘空间并扩展文件大小，文件系统不支持时返回 false
+func fallocate(fd *os.File, size int64) (bool, error) {
+	err := unix.Fallocate(int(fd.Fd()), 0, 0, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 只持久化数据和必要的元数据，文件大小没有变化时不需要更新 inode
+func datasync(fd *os.File) error {
+	return unix.Fdatasync(int(fd.Fd()))
+}
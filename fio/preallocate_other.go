@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fio
+
+import "os"
+
+// 当前平台不支持预分配
+func fallocate(fd *os.File, size int64) (bool, error) {
+	return false, nil
+}
+
+func datasync(fd *os.File) error {
+	return fd.Sync()
+}
@@ -106,6 +106,18 @@ func handleStat(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(stat)
 }
 
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := db.WritePrometheus(w); err != nil {
+		log.Printf("failed to write metrics: %v\n", err)
+	}
+}
+
 func main() {
 	// 注册处理方法
 	http.HandleFunc("/bitcask/put", handlePut)
@@ -113,6 +125,7 @@ func main() {
 	http.HandleFunc("/bitcask/delete", handleDelete)
 	http.HandleFunc("/bitcask/listkeys", handleListKeys)
 	http.HandleFunc("/bitcask/stat", handleStat)
+	http.HandleFunc("/bitcask/metrics", handleMetrics)
 
 	_ = http.ListenAndServe("localhost:8080", nil)
 }
@@ -6,13 +6,15 @@ import (
 	goart "github.com/plar/go-adaptive-radix-tree"
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 // AdaptiveRadixTree 自适应基数树索引
 // 主要是封装了 https://github.com/plar/go-adaptive-radix-tree
 type AdaptiveRadixTree struct {
-	tree goart.Tree
-	lock *sync.RWMutex
+	tree   goart.Tree
+	lock   *sync.RWMutex
+	memory atomic.Int64 // 估算的内存占用
 }
 
 // NewART 初始化自适应基数树
@@ -25,8 +27,11 @@ func NewART() *AdaptiveRadixTree {
 
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	art.lock.Lock()
-	oldValue, _ := art.tree.Insert(key, pos)
+	oldValue, updated := art.tree.Insert(key, pos)
 	art.lock.Unlock()
+	if !updated {
+		art.memory.Add(int64(len(key) + artEntryOverhead))
+	}
 	if oldValue == nil {
 		return nil
 	}
@@ -47,12 +52,50 @@ func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
 	oldValue, deleted := art.tree.Delete(key)
 	art.lock.Unlock()
+	if deleted {
+		art.memory.Add(-int64(len(key) + artEntryOverhead))
+	}
 	if oldValue == nil {
 		return nil, false
 	}
 	return oldValue.(*data.LogRecordPos), deleted
 }
 
+// ApplyBatch 批量更新索引，整个批次只加一次锁
+func (art *AdaptiveRadixTree) ApplyBatch(entries []*BatchEntry) []*data.LogRecordPos {
+	oldPositions := make([]*data.LogRecordPos, len(entries))
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	for i, entry := range entries {
+		var oldValue goart.Value
+		if entry.Delete {
+			var deleted bool
+			if oldValue, deleted = art.tree.Delete(entry.Key); deleted {
+				art.memory.Add(-int64(len(entry.Key) + artEntryOverhead))
+			}
+		} else {
+			var updated bool
+			if oldValue, updated = art.tree.Insert(entry.Key, entry.Pos); !updated {
+				art.memory.Add(int64(len(entry.Key) + artEntryOverhead))
+			}
+		}
+		if oldValue != nil {
+			oldPositions[i] = oldValue.(*data.LogRecordPos)
+		}
+	}
+	return oldPositions
+}
+
+// EntryMemory 一个新的 key 增加的内存占用
+func (art *AdaptiveRadixTree) EntryMemory(keySize int) int64 {
+	return int64(keySize + artEntryOverhead)
+}
+
+// MemoryUsage 索引占用内存的估算值
+func (art *AdaptiveRadixTree) MemoryUsage() int64 {
+	return art.memory.Load()
+}
+
 func (art *AdaptiveRadixTree) Size() int {
 	art.lock.Lock()
 	size := art.tree.Size()
@@ -61,10 +104,10 @@ func (art *AdaptiveRadixTree) Size() int {
 }
 
 // Iterator 索引迭代器
+// 自适应基数树不支持写时复制，也不支持从指定的 key 开始有序遍历，创建迭代器时持有读锁遍历一次，
+// 拷贝所有的 key 和位置索引作为快照，内存占用与 key 的数量成正比，key 很多时应该使用 BTree 索引
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+	return newARTIterator(art, reverse)
 }
 
 func (art *AdaptiveRadixTree) Close() error {
@@ -73,37 +116,33 @@ func (art *AdaptiveRadixTree) Close() error {
 
 // Art 索引迭代器
 type artIterator struct {
-	currIndex int     // 当前遍历的下标位置
-	reverse   bool    // 是否是反向遍历
-	values    []*Item // key + 位置索引
+	currIndex int    // 当前遍历的下标位置
+	reverse   bool   // 是否是反向遍历
+	values    []Item // 创建时索引的快照，按遍历的顺序排列
 }
 
-func newARTIterator(tree goart.Tree, reverse bool) *artIterator {
+func newARTIterator(art *AdaptiveRadixTree, reverse bool) *artIterator {
+	art.lock.RLock()
+	values := make([]Item, art.tree.Size())
 	var idx int
 	if reverse {
-		idx = tree.Size() - 1
+		idx = len(values) - 1
 	}
-	values := make([]*Item, tree.Size())
-	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-		values[idx] = item
+	// ForEach 按照 key 从小到大的顺序遍历叶子节点
+	art.tree.ForEach(func(node goart.Node) bool {
+		values[idx] = Item{key: node.Key(), pos: node.Value().(*data.LogRecordPos)}
 		if reverse {
 			idx--
 		} else {
 			idx++
 		}
 		return true
-	}
-
-	tree.ForEach(saveValues)
+	})
+	art.lock.RUnlock()
 
 	return &artIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+		reverse: reverse,
+		values:  values,
 	}
 }
 
@@ -77,3 +77,36 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	}
 
 }
+
+func TestAdaptiveRadixTree_Iterator_Order(t *testing.T) {
+	art := NewART()
+	testIteratorOrder(t, art)
+}
+
+// 迭代器创建之后的修改不会影响遍历结果
+func TestAdaptiveRadixTree_Iterator_Snapshot(t *testing.T) {
+	art := NewART()
+	for i := 0; i < 1000; i++ {
+		art.Put([]byte{byte(i >> 8), byte(i)}, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter := art.Iterator(false)
+	for i := 0; i < 1000; i++ {
+		art.Delete([]byte{byte(i >> 8), byte(i)})
+		art.Put([]byte{0xff, byte(i >> 8), byte(i)}, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, int64(count), iter.Value().Offset)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iter.Close()
+}
+
+func TestAdaptiveRadixTree_ApplyBatch(t *testing.T) {
+	testApplyBatch(t, NewART())
+}
+
+func TestAdaptiveRadixTree_MemoryUsage(t *testing.T) {
+	testMemoryUsage(t, NewART())
+}
@@ -0,0 +1,124 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+// 布隆过滤器的最小容量，避免数据量很少时频繁扩容
+const bloomMinCapacity = 1024
+
+// 编码后的头部长度：m(8) + k(4) + capacity(8)
+const bloomHeaderSize = 20
+
+var errBloomFilterCorrupted = errors.New("the bloom filter is corrupted")
+
+// bloomFilter 布隆过滤器，用于快速判断 key 一定不存在
+// 位数组使用原子操作读写，Add 和 MayContain 可以并发调用
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64 // 位数组的长度
+	k        uint32 // 哈希函数的个数
+	capacity uint64 // 误判率不超过设定值时能够容纳的 key 数量
+}
+
+// 根据容量和误判率计算位数组的长度和哈希函数的个数
+func newBloomFilter(capacity uint64, falsePositive float64) *bloomFilter {
+	if capacity < bloomMinCapacity {
+		capacity = bloomMinCapacity
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositive) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:     make([]uint64, m/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+// 计算 key 的两个哈希值，其余的哈希值由这两个组合得到
+// 哈希函数需要在每次启动时保持一致，因此不能使用带随机种子的哈希
+func bloomHash(key []byte) (uint64, uint64) {
+	// FNV-1a
+	h1 := uint64(14695981039346656037)
+	for _, b := range key {
+		h1 ^= uint64(b)
+		h1 *= 1099511628211
+	}
+	// splitmix64 的混淆函数
+	h2 := h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ (h2 >> 30)) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ (h2 >> 27)) * 0x94d049bb133111eb
+	h2 ^= h2 >> 31
+	return h1, h2 | 1
+}
+
+func (bf *bloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.m
+		word, mask := &bf.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// MayContain 返回 false 时 key 一定不存在，返回 true 时 key 可能存在
+func (bf *bloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.m
+		if atomic.LoadUint64(&bf.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode 编码布隆过滤器
+//
+//	+-------+-------+-------------+--------------+
+//	|   m   |   k   |  capacity   |    bits      |
+//	+-------+-------+-------------+--------------+
+//	   8       4          8          m / 8
+func (bf *bloomFilter) Encode() []byte {
+	buf := make([]byte, bloomHeaderSize+len(bf.bits)*8)
+	binary.LittleEndian.PutUint64(buf[0:], bf.m)
+	binary.LittleEndian.PutUint32(buf[8:], bf.k)
+	binary.LittleEndian.PutUint64(buf[12:], bf.capacity)
+	for i := range bf.bits {
+		binary.LittleEndian.PutUint64(buf[bloomHeaderSize+i*8:], atomic.LoadUint64(&bf.bits[i]))
+	}
+	return buf
+}
+
+// 解码布隆过滤器
+func decodeBloomFilter(buf []byte) (*bloomFilter, error) {
+	if len(buf) < bloomHeaderSize {
+		return nil, errBloomFilterCorrupted
+	}
+	bf := &bloomFilter{
+		m:        binary.LittleEndian.Uint64(buf[0:]),
+		k:        binary.LittleEndian.Uint32(buf[8:]),
+		capacity: binary.LittleEndian.Uint64(buf[12:]),
+	}
+	if bf.m == 0 || bf.m%64 != 0 || bf.k == 0 || uint64(len(buf)-bloomHeaderSize) != bf.m/8 {
+		return nil, errBloomFilterCorrupted
+	}
+	bf.bits = make([]uint64, bf.m/64)
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(buf[bloomHeaderSize+i*8:])
+	}
+	return bf, nil
+}
@@ -2,50 +2,129 @@ package index
 
 import (
 	"bitcask-go/data"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"go.etcd.io/bbolt"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
-const bptreeIndexFileName = "bptree-index"
+// ErrIndexCorrupted 磁盘上的索引文件损坏，需要从数据文件重建
+var ErrIndexCorrupted = errors.New("the index file is corrupted")
+
+// BPTreeIndexFileName B+ 树索引文件的名称
+const BPTreeIndexFileName = "bptree-index"
+
+// BPTreeRebuildFileName 重建B+树索引时使用的临时文件，重建完成之后重命名为 BPTreeIndexFileName
+const BPTreeRebuildFileName = BPTreeIndexFileName + ".rebuild"
 
 var indexBucketName = []byte("bitcask-index")
 
+// 存储元数据（例如事务序列号）的 bucket
+var metaBucketName = []byte("bitcask-meta")
+var seqNoKey = []byte("seq-no")
+
+// 持久化布隆过滤器的 bucket
+var bloomBucketName = []byte("bitcask-bloom")
+var bloomFilterKey = []byte("filter")
+
 // BPlusTree B+ 树索引
 // 主要封装了go.etcd.io/bblot 库
+// 可以在内存中维护所有 key 的布隆过滤器，不存在的 key 不需要开启 bbolt 的事务
 type BPlusTree struct {
-	tree *bbolt.DB
+	tree               *bbolt.DB
+	bloom              *bloomFilter  // 布隆过滤器，为 nil 表示不使用
+	bloomNext          *bloomFilter  // 正在构建的新布隆过滤器，写入的 key 同时加入其中
+	bloomLock          *sync.RWMutex // 替换布隆过滤器时短暂阻塞写入，保证新的过滤器包含所有的 key
+	bloomBuildLock     *sync.Mutex   // 同一时间只构建一个新的布隆过滤器
+	bloomFalsePositive float64       // 布隆过滤器的误判率
+	bloomKeys          atomic.Uint64 // 加入布隆过滤器的 key 数量
 }
 
 // NewBPlusTree 初始化B+树索引
-func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+// bloomFalsePositive 为布隆过滤器的误判率，为 0 表示不使用布隆过滤器
+func NewBPlusTree(dirPath string, syncWrites bool, bloomFalsePositive float64) *BPlusTree {
+	bpt, err := OpenBPlusTree(dirPath, syncWrites, bloomFalsePositive)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open bptree, %v", err))
+	}
+	return bpt
+}
+
+// OpenBPlusTree 打开B+树索引，索引文件损坏时返回错误
+func OpenBPlusTree(dirPath string, syncWrites bool, bloomFalsePositive float64) (*BPlusTree, error) {
+	return OpenBPlusTreeFile(filepath.Join(dirPath, BPTreeIndexFileName), syncWrites, bloomFalsePositive)
+}
+
+// OpenBPlusTreeFile 打开指定文件中的B+树索引，索引文件损坏时返回错误
+func OpenBPlusTreeFile(fileName string, syncWrites bool, bloomFalsePositive float64) (*BPlusTree, error) {
+	// 已经存在的索引文件中必须有对应的 Bucket
+	var existing bool
+	if stat, err := os.Stat(fileName); err == nil && stat.Size() > 0 {
+		existing = true
+	}
+
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
-	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	bptree, err := bbolt.Open(fileName, 0644, opts)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, fmt.Errorf("%w: %v", ErrIndexCorrupted, err)
 	}
 
+	bpt := &BPlusTree{
+		tree:               bptree,
+		bloomLock:          new(sync.RWMutex),
+		bloomBuildLock:     new(sync.Mutex),
+		bloomFalsePositive: bloomFalsePositive,
+	}
 	// 创建对应的Bucket
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
+		if existing && tx.Bucket(indexBucketName) == nil {
+			return fmt.Errorf("%w: bucket %s not found", ErrIndexCorrupted, indexBucketName)
+		}
 		_, err := tx.CreateBucketIfNotExists(indexBucketName)
-		return err
+		if err != nil {
+			return err
+		}
+		if bloomFalsePositive > 0 {
+			bpt.loadBloomFilter(tx)
+		}
+		return nil
 	}); err != nil {
-		panic("failed to create bucket in bptree")
+		_ = bptree.Close()
+		return nil, err
 	}
-	return &BPlusTree{tree: bptree}
+	// 没有可用的持久化布隆过滤器，从索引中重建
+	if bloomFalsePositive > 0 && bpt.bloom == nil {
+		if err := bpt.rebuildBloomFilter(); err != nil {
+			_ = bptree.Close()
+			return nil, err
+		}
+	}
+	return bpt, nil
 }
 
 // Put 向索引中存储key对应的数据位置信息
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	var oldVal []byte
-	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+	// 先加入布隆过滤器再写入，保证并发读取时不会漏掉已经写入的 key
+	bpt.bloomLock.RLock()
+	bpt.addToBloomFilter(key)
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		oldVal = bucket.Get(key)
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
-	}); err != nil {
+	})
+	bpt.bloomLock.RUnlock()
+	if err != nil {
 		panic("failed to put value in bptree")
 	}
 	if len(oldVal) == 0 {
+		bpt.growBloomFilter(1)
 		return nil
 	}
 	return data.DecodeLogRecordPos(oldVal)
@@ -53,6 +132,9 @@ func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
 
 // Get 根据key取出对应的索引位置信息
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+	if !bpt.mayContain(key) {
+		return nil
+	}
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -69,6 +151,9 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 
 // Delete 根据key删除对应的索引位置信息
 func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+	if !bpt.mayContain(key) {
+		return nil, false
+	}
 	var oldVal []byte
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -85,6 +170,116 @@ func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	return data.DecodeLogRecordPos(oldVal), true
 }
 
+// ApplyBatch 在一个 bbolt 事务中批量更新索引
+func (bpt *BPlusTree) ApplyBatch(entries []*BatchEntry) []*data.LogRecordPos {
+	oldPositions := make([]*data.LogRecordPos, len(entries))
+	var newKeys uint64
+	bpt.bloomLock.RLock()
+	for _, entry := range entries {
+		if !entry.Delete {
+			bpt.addToBloomFilter(entry.Key)
+		}
+	}
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		newKeys = 0
+		for i, entry := range entries {
+			oldVal := bucket.Get(entry.Key)
+			if len(oldVal) != 0 {
+				oldPositions[i] = data.DecodeLogRecordPos(oldVal)
+			}
+			if entry.Delete {
+				if len(oldVal) != 0 {
+					if err := bucket.Delete(entry.Key); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if len(oldVal) == 0 {
+				newKeys++
+			}
+			if err := bucket.Put(entry.Key, data.EncodeLogRecordPos(entry.Pos)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	bpt.bloomLock.RUnlock()
+	if err != nil {
+		panic("failed to apply batch in bptree")
+	}
+	if newKeys > 0 {
+		bpt.growBloomFilter(newKeys)
+	}
+	return oldPositions
+}
+
+// Persistent B+ 树索引保存在磁盘上，启动时不需要重放数据文件
+func (bpt *BPlusTree) Persistent() bool {
+	return true
+}
+
+// LoadSeqNo 读取持久化的事务序列号
+func (bpt *BPlusTree) LoadSeqNo() (uint64, error) {
+	var seqNo uint64
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metaBucketName)
+		if bucket == nil {
+			return nil
+		}
+		if value := bucket.Get(seqNoKey); len(value) == 8 {
+			seqNo = binary.LittleEndian.Uint64(value)
+		}
+		return nil
+	})
+	return seqNo, err
+}
+
+// SaveSeqNo 持久化事务序列号
+// 没有开启同步写入时 bbolt 不会 fsync，这里需要手动持久化
+func (bpt *BPlusTree) SaveSeqNo(seqNo uint64) error {
+	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, seqNo)
+		return bucket.Put(seqNoKey, value)
+	}); err != nil {
+		return err
+	}
+	if bpt.tree.NoSync {
+		return bpt.tree.Sync()
+	}
+	return nil
+}
+
+// EntryMemory 一个新的 key 增加的内存占用
+// 和 MemoryUsage 一样只计算布隆过滤器，key 本身保存在索引文件中，不占用内存
+// 布隆过滤器按照 key 数量的两倍扩容，按照扩容之后每个 key 平均占用的大小估算
+func (bpt *BPlusTree) EntryMemory(keySize int) int64 {
+	bpt.bloomLock.RLock()
+	defer bpt.bloomLock.RUnlock()
+	if bpt.bloom == nil {
+		return 0
+	}
+	capacity := int64(bpt.bloom.capacity)
+	return (int64(len(bpt.bloom.bits)*8)*2 + capacity - 1) / capacity
+}
+
+// MemoryUsage 索引占用内存的估算值
+// 索引数据通过 mmap 映射，由操作系统的页缓存管理，不计算在内，只计算内存中的布隆过滤器
+func (bpt *BPlusTree) MemoryUsage() int64 {
+	bpt.bloomLock.RLock()
+	defer bpt.bloomLock.RUnlock()
+	if bpt.bloom == nil {
+		return 0
+	}
+	return int64(len(bpt.bloom.bits) * 8)
+}
+
 // Size 索引中的数据量
 func (bpt *BPlusTree) Size() int {
 	var size int
@@ -103,10 +298,166 @@ func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
 	return newBptreeIterator(bpt.tree, reverse)
 }
 
+// Sync 持久化索引文件，没有开启同步写入时 bbolt 的事务提交不会 fsync
+func (bpt *BPlusTree) Sync() error {
+	return bpt.tree.Sync()
+}
+
 func (bpt *BPlusTree) Close() error {
+	if err := bpt.saveBloomFilter(); err != nil {
+		_ = bpt.tree.Close()
+		return err
+	}
 	return bpt.tree.Close()
 }
 
+// RebuildBloomFilter 根据索引中当前的 key 重建布隆过滤器
+// 布隆过滤器不能删除 key，删除较多之后（例如 merge 之后）可以重建以降低误判率
+func (bpt *BPlusTree) RebuildBloomFilter() error {
+	if bpt.bloomFalsePositive <= 0 {
+		return nil
+	}
+	bpt.bloomBuildLock.Lock()
+	defer bpt.bloomBuildLock.Unlock()
+	return bpt.buildBloomFilter(uint64(bpt.Size()) * 2)
+}
+
+// 判断 key 是否可能存在，没有使用布隆过滤器时总是返回 true
+func (bpt *BPlusTree) mayContain(key []byte) bool {
+	bpt.bloomLock.RLock()
+	defer bpt.bloomLock.RUnlock()
+	return bpt.bloom == nil || bpt.bloom.MayContain(key)
+}
+
+// 将 key 加入布隆过滤器，正在构建新的过滤器时同时加入新的过滤器
+// 调用时必须持有 bloomLock 的读锁
+func (bpt *BPlusTree) addToBloomFilter(key []byte) {
+	if bpt.bloom != nil {
+		bpt.bloom.Add(key)
+	}
+	if bpt.bloomNext != nil {
+		bpt.bloomNext.Add(key)
+	}
+}
+
+// 加入的 key 数量超过了布隆过滤器的容量，误判率会升高，按两倍的容量重建
+// 已经有其他的写入在重建时直接返回，不等待重建完成
+func (bpt *BPlusTree) growBloomFilter(added uint64) {
+	if bpt.bloomFalsePositive <= 0 {
+		return
+	}
+	bpt.bloomLock.RLock()
+	capacity := bpt.bloom.capacity
+	bpt.bloomLock.RUnlock()
+	if bpt.bloomKeys.Add(added) <= capacity || !bpt.bloomBuildLock.TryLock() {
+		return
+	}
+	defer bpt.bloomBuildLock.Unlock()
+
+	bpt.bloomLock.RLock()
+	capacity = bpt.bloom.capacity
+	bpt.bloomLock.RUnlock()
+	if keys := bpt.bloomKeys.Load(); keys > capacity {
+		// 重建失败时继续使用原来的过滤器，只是误判率较高
+		_ = bpt.buildBloomFilter(keys * 2)
+	}
+}
+
+// 在不阻塞读写的情况下构建容量为 capacity 的布隆过滤器，构建完成之后替换当前的过滤器
+// 先登记新的过滤器，之后的写入会同时加入其中，再在只读事务中加入之前已经写入的 key
+// 只有登记和替换时短暂持有 bloomLock 的写锁，调用时必须持有 bloomBuildLock
+func (bpt *BPlusTree) buildBloomFilter(capacity uint64) error {
+	bloom := newBloomFilter(capacity, bpt.bloomFalsePositive)
+	bpt.bloomLock.Lock()
+	bpt.bloomNext = bloom
+	startKeys := bpt.bloomKeys.Load()
+	bpt.bloomLock.Unlock()
+
+	var keyNum uint64
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+			bloom.Add(k)
+			keyNum++
+			return nil
+		})
+	})
+
+	bpt.bloomLock.Lock()
+	defer bpt.bloomLock.Unlock()
+	bpt.bloomNext = nil
+	if err != nil {
+		return err
+	}
+	bpt.bloom = bloom
+	// 构建期间新增的 key 可能已经被计入 keyNum，宁可多算，提前扩容
+	bpt.bloomKeys.Store(keyNum + bpt.bloomKeys.Load() - startKeys)
+	return nil
+}
+
+// 遍历索引中所有的 key 重建布隆过滤器，容量为 key 数量的两倍
+// 只在打开索引时调用，这时还没有开始并发访问
+func (bpt *BPlusTree) rebuildBloomFilter() error {
+	return bpt.tree.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		keyNum := uint64(bucket.Stats().KeyN)
+		bloom := newBloomFilter(keyNum*2, bpt.bloomFalsePositive)
+		if err := bucket.ForEach(func(k, v []byte) error {
+			bloom.Add(k)
+			return nil
+		}); err != nil {
+			return err
+		}
+		bpt.bloom = bloom
+		bpt.bloomKeys.Store(keyNum)
+		return nil
+	})
+}
+
+// 加载持久化的布隆过滤器
+// 布隆过滤器在关闭时和当时的事务 id 一起保存，之后只要 bbolt 中有过其他的写事务，
+// 保存的过滤器就可能缺少 key，不能再使用
+func (bpt *BPlusTree) loadBloomFilter(tx *bbolt.Tx) {
+	bucket := tx.Bucket(bloomBucketName)
+	if bucket == nil {
+		return
+	}
+	value := bucket.Get(bloomFilterKey)
+	if len(value) < 16 {
+		return
+	}
+	// 当前是一个写事务，事务 id 比上一个事务大 1
+	if binary.LittleEndian.Uint64(value[0:]) != uint64(tx.ID()-1) {
+		return
+	}
+	bloom, err := decodeBloomFilter(value[16:])
+	if err != nil {
+		return
+	}
+	bpt.bloom = bloom
+	bpt.bloomKeys.Store(binary.LittleEndian.Uint64(value[8:]))
+}
+
+// 持久化布隆过滤器
+func (bpt *BPlusTree) saveBloomFilter() error {
+	bpt.bloomLock.RLock()
+	defer bpt.bloomLock.RUnlock()
+	if bpt.bloom == nil {
+		return nil
+	}
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bloomBucketName)
+		if err != nil {
+			return err
+		}
+		encBloom := bpt.bloom.Encode()
+		value := make([]byte, 16+len(encBloom))
+		binary.LittleEndian.PutUint64(value[0:], uint64(tx.ID()))
+		binary.LittleEndian.PutUint64(value[8:], bpt.bloomKeys.Load())
+		copy(value[16:], encBloom)
+		return bucket.Put(bloomFilterKey, value)
+	})
+}
+
 type bptreeIterator struct {
 	tx        *bbolt.Tx
 	cursor    *bbolt.Cursor
@@ -141,6 +492,15 @@ func (bpi *bptreeIterator) Rewind() {
 // Seek 根据传入的key查找到第一个大于（或小于）等于的目标key， 根据从这个key开始遍历
 func (bpi *bptreeIterator) Seek(key []byte) {
 	bpi.currKey, bpi.currValue = bpi.cursor.Seek(key)
+	if !bpi.reverse {
+		return
+	}
+	// cursor 只能找到第一个大于等于的key，反向遍历时需要退回到小于等于的key
+	if bpi.currKey == nil {
+		bpi.currKey, bpi.currValue = bpi.cursor.Last()
+	} else if !bytes.Equal(bpi.currKey, key) {
+		bpi.currKey, bpi.currValue = bpi.cursor.Prev()
+	}
 }
 
 // Next 跳转到下一个key
@@ -2,9 +2,11 @@ package index
 
 import (
 	"bitcask-go/data"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -14,7 +16,7 @@ func TestNewBPTree_Put(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree := NewBPlusTree(path, false, 0)
 
 	res1 := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	assert.Nil(t, res1)
@@ -36,7 +38,7 @@ func TestNewBPTree_Get(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree := NewBPlusTree(path, false, 0)
 
 	pos := tree.Get([]byte("not exist"))
 	assert.Nil(t, pos)
@@ -56,7 +58,7 @@ func TestNewBPTree_Delete(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree := NewBPlusTree(path, false, 0)
 
 	res1, ok1 := tree.Delete([]byte("not exist"))
 	assert.False(t, ok1)
@@ -78,7 +80,7 @@ func TestNewBPTree_Size(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree := NewBPlusTree(path, false, 0)
 
 	assert.Equal(t, 0, tree.Size())
 
@@ -94,7 +96,7 @@ func TestNewBPlusTree_Iterator(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree := NewBPlusTree(path, false, 0)
 
 	tree.Put([]byte("caac"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("bbca"), &data.LogRecordPos{Fid: 123, Offset: 999})
@@ -106,3 +108,155 @@ func TestNewBPlusTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Key())
 	}
 }
+
+func TestNewBPlusTree_Iterator_Seek(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-iter-seek")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false, 0)
+
+	tree.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	tree.Put([]byte("cc"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	tree.Put([]byte("ee"), &data.LogRecordPos{Fid: 1, Offset: 3})
+
+	iter1 := tree.Iterator(false)
+	iter1.Seek([]byte("bb"))
+	assert.Equal(t, []byte("cc"), iter1.Key())
+	iter1.Close()
+
+	// 反向遍历时找到第一个小于等于的key
+	iter2 := tree.Iterator(true)
+	iter2.Seek([]byte("dd"))
+	assert.Equal(t, []byte("cc"), iter2.Key())
+	iter2.Seek([]byte("cc"))
+	assert.Equal(t, []byte("cc"), iter2.Key())
+	iter2.Seek([]byte("zz"))
+	assert.Equal(t, []byte("ee"), iter2.Key())
+	iter2.Seek([]byte("a"))
+	assert.False(t, iter2.Valid())
+	iter2.Close()
+}
+
+func TestNewBPlusTree_BloomFilter(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-bloom")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false, 0.01)
+	assert.NotNil(t, tree.bloom)
+
+	// 写入的 key 超过了初始容量，布隆过滤器会扩容
+	for i := 0; i < 5000; i++ {
+		tree.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.GreaterOrEqual(t, tree.bloom.capacity, uint64(5000))
+	for i := 0; i < 5000; i++ {
+		assert.NotNil(t, tree.Get([]byte(fmt.Sprintf("key-%05d", i))))
+	}
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if tree.mayContain([]byte(fmt.Sprintf("absent-%05d", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+
+	// 关闭时持久化，重新打开时直接加载
+	err := tree.Close()
+	assert.Nil(t, err)
+	tree2 := NewBPlusTree(path, false, 0.01)
+	assert.Equal(t, uint64(5000), tree2.bloomKeys.Load())
+	assert.NotNil(t, tree2.Get([]byte("key-00001")))
+	assert.Nil(t, tree2.Get([]byte("absent")))
+	err = tree2.Close()
+	assert.Nil(t, err)
+
+	// 不使用布隆过滤器时写入了数据，持久化的过滤器失效，需要重建
+	tree3 := NewBPlusTree(path, false, 0)
+	tree3.Put([]byte("new-key"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	err = tree3.Close()
+	assert.Nil(t, err)
+	tree4 := NewBPlusTree(path, false, 0.01)
+	assert.Equal(t, uint64(5001), tree4.bloomKeys.Load())
+	assert.NotNil(t, tree4.Get([]byte("new-key")))
+	_ = tree4.Close()
+}
+
+// 布隆过滤器在并发写入的同时扩容，扩容之后仍然包含所有的 key
+func TestNewBPlusTree_BloomFilter_ConcurrentGrow(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-bloom-grow")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false, 0.01)
+	defer func() {
+		_ = tree.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%05d", w, i))
+				tree.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+				// 写入之后立即可以查到，不会被扩容中的过滤器漏掉
+				assert.NotNil(t, tree.Get(key))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.GreaterOrEqual(t, tree.bloom.capacity, uint64(16000))
+	assert.Nil(t, tree.bloomNext)
+	for w := 0; w < 8; w++ {
+		for i := 0; i < 2000; i++ {
+			assert.True(t, tree.mayContain([]byte(fmt.Sprintf("key-%d-%05d", w, i))))
+		}
+	}
+	assert.Nil(t, tree.RebuildBloomFilter())
+	assert.True(t, tree.mayContain([]byte("key-7-01999")))
+}
+
+// EntryMemory 和 MemoryUsage 使用同样的估算方式，都只计算布隆过滤器
+func TestNewBPlusTree_MemoryUsage(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-memory")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false, 0.01)
+	usage := tree.MemoryUsage()
+	assert.Greater(t, usage, int64(0))
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		usage += tree.EntryMemory(len(key))
+		tree.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		assert.LessOrEqual(t, tree.MemoryUsage(), usage)
+	}
+	// 估算值不会超过实际占用太多
+	assert.Less(t, usage, tree.MemoryUsage()*2)
+	assert.Nil(t, tree.Close())
+
+	// 不使用布隆过滤器时不占用内存
+	tree2 := NewBPlusTree(path, false, 0)
+	assert.Equal(t, int64(0), tree2.EntryMemory(16))
+	assert.Equal(t, int64(0), tree2.MemoryUsage())
+	assert.Nil(t, tree2.Close())
+}
+
+func TestNewBPlusTree_ApplyBatch(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-batch")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false, 0.01)
+	testApplyBatch(t, tree)
+	_ = tree.Close()
+}
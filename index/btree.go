@@ -4,14 +4,15 @@ import (
 	"bitcask-go/data"
 	"bytes"
 	"github.com/google/btree"
-	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 // BTree 索引
 type BTree struct {
-	tree *btree.BTree
-	lock *sync.RWMutex
+	tree   *btree.BTree
+	lock   *sync.RWMutex
+	memory atomic.Int64 // 估算的内存占用
 }
 
 func NewBTree() *BTree {
@@ -30,6 +31,7 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	oldItem := bt.tree.ReplaceOrInsert(it)
 	bt.lock.Unlock()
 	if oldItem == nil {
+		bt.memory.Add(int64(len(key) + btreeEntryOverhead))
 		return nil
 	}
 	return oldItem.(*Item).pos
@@ -37,7 +39,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -52,20 +56,58 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	if oldItem == nil {
 		return nil, false
 	}
+	bt.memory.Add(-int64(len(key) + btreeEntryOverhead))
 	return oldItem.(*Item).pos, true
 }
 
+// ApplyBatch 批量更新索引，整个批次只加一次锁
+func (bt *BTree) ApplyBatch(entries []*BatchEntry) []*data.LogRecordPos {
+	oldPositions := make([]*data.LogRecordPos, len(entries))
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	for i, entry := range entries {
+		var oldItem btree.Item
+		if entry.Delete {
+			if oldItem = bt.tree.Delete(&Item{key: entry.Key}); oldItem != nil {
+				bt.memory.Add(-int64(len(entry.Key) + btreeEntryOverhead))
+			}
+		} else if oldItem = bt.tree.ReplaceOrInsert(&Item{key: entry.Key, pos: entry.Pos}); oldItem == nil {
+			bt.memory.Add(int64(len(entry.Key) + btreeEntryOverhead))
+		}
+		if oldItem != nil {
+			oldPositions[i] = oldItem.(*Item).pos
+		}
+	}
+	return oldPositions
+}
+
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
+// EntryMemory 一个新的 key 增加的内存占用
+func (bt *BTree) EntryMemory(keySize int) int64 {
+	return int64(keySize + btreeEntryOverhead)
+}
+
+// MemoryUsage 索引占用内存的估算值
+func (bt *BTree) MemoryUsage() int64 {
+	return bt.memory.Load()
+}
+
+// Iterator 索引迭代器
+// 迭代器遍历的是创建时索引的写时复制快照，创建的开销为 O(1)，遍历过程中按批次读取数据
 func (bt *BTree) Iterator(reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return newBtreeIterator(bt.tree, reverse)
+	// Clone 会修改原树的写时复制标记，需要持有写锁
+	bt.lock.Lock()
+	snapshot := bt.tree.Clone()
+	bt.lock.Unlock()
+	return newBtreeIterator(snapshot, reverse)
 }
 
 func (bt *BTree) Close() error {
@@ -74,52 +116,64 @@ func (bt *BTree) Close() error {
 
 // BTree 索引迭代器
 type btreeIterator struct {
-	currIndex int     // 当前遍历的下标位置
-	reverse   bool    // 是否是反向遍历
-	values    []*Item // key + 位置索引
+	tree      *btree.BTree // 创建迭代器时索引的快照
+	currIndex int          // 当前批次中遍历的下标位置
+	reverse   bool         // 是否是反向遍历
+	values    []*Item      // 当前批次的 key + 位置索引
+	hasMore   bool         // 当前批次之后是否还可能有数据
 }
 
 func newBtreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
+	bti := &btreeIterator{
+		tree:    tree,
+		reverse: reverse,
+	}
+	bti.Rewind()
+	return bti
+}
 
+// 从pivot开始加载一个批次的数据，pivot为nil则从头开始，skipPivot表示是否跳过与pivot相同的key
+func (bti *btreeIterator) loadBatch(pivot *Item, skipPivot bool) {
+	values := bti.values[:0]
 	saveValues := func(item btree.Item) bool {
-		values[idx] = item.(*Item)
-		idx++
-		return true
+		it := item.(*Item)
+		if skipPivot && bytes.Equal(it.key, pivot.key) {
+			return true
+		}
+		values = append(values, it)
+		return len(values) < iteratorBatchSize
 	}
 
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
+	switch {
+	case pivot == nil && bti.reverse:
+		bti.tree.Descend(saveValues)
+	case pivot == nil:
+		bti.tree.Ascend(saveValues)
+	case bti.reverse:
+		bti.tree.DescendLessOrEqual(pivot, saveValues)
+	default:
+		bti.tree.AscendGreaterOrEqual(pivot, saveValues)
 	}
 
-	return &btreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
-	}
+	bti.values = values
+	bti.currIndex = 0
+	bti.hasMore = len(values) == iteratorBatchSize
 }
 
 func (bti *btreeIterator) Rewind() {
-	bti.currIndex = 0
+	bti.loadBatch(nil, false)
 }
 
 func (bti *btreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
-	} else {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
-	}
+	bti.loadBatch(&Item{key: key}, false)
 }
 
 func (bti *btreeIterator) Next() {
 	bti.currIndex += 1
+	if bti.currIndex >= len(bti.values) && bti.hasMore {
+		// 当前批次遍历完了，从最后一个key之后加载下一个批次
+		bti.loadBatch(bti.values[len(bti.values)-1], true)
+	}
 }
 
 func (bti *btreeIterator) Valid() bool {
@@ -135,5 +189,7 @@ func (bti *btreeIterator) Value() *data.LogRecordPos {
 }
 
 func (bti *btreeIterator) Close() {
+	bti.tree = nil
 	bti.values = nil
+	bti.hasMore = false
 }
@@ -2,7 +2,10 @@ package index
 
 import (
 	"bitcask-go/data"
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
 	"testing"
 )
 
@@ -129,3 +132,141 @@ func TestBTree_Iterator(t *testing.T) {
 	}
 
 }
+
+func TestBTree_Iterator_Batches(t *testing.T) {
+	bt := NewBTree()
+	testIteratorOrder(t, bt)
+}
+
+// 迭代器创建之后的修改不会影响遍历结果
+func TestBTree_Iterator_Snapshot(t *testing.T) {
+	bt := NewBTree()
+	for i := 0; i < 1000; i++ {
+		bt.Put([]byte{byte(i >> 8), byte(i)}, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter := bt.Iterator(false)
+	for i := 0; i < 1000; i++ {
+		bt.Delete([]byte{byte(i >> 8), byte(i)})
+	}
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iter.Close()
+}
+
+// 随机写入数据，校验正向、反向遍历和seek的结果与排序后的结果一致，数据量跨越多个批次
+func testIteratorOrder(t *testing.T, indexer Indexer) {
+	r := rand.New(rand.NewSource(1))
+	keySet := make(map[string]struct{})
+	for i := 0; i < 3000; i++ {
+		// 使用较小的字符集和不同的长度，构造大量共同前缀
+		key := make([]byte, 1+r.Intn(6))
+		for j := range key {
+			key[j] = "abc\x00\xff"[r.Intn(5)]
+		}
+		keySet[string(key)] = struct{}{}
+		indexer.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	var keys []string
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	collect := func(iter Iterator) []string {
+		result := make([]string, 0)
+		for ; iter.Valid(); iter.Next() {
+			result = append(result, string(iter.Key()))
+		}
+		return result
+	}
+
+	iter := indexer.Iterator(false)
+	iter.Rewind()
+	assert.Equal(t, keys, collect(iter))
+	iter.Close()
+
+	reversed := make([]string, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+	reverseIter := indexer.Iterator(true)
+	reverseIter.Rewind()
+	assert.Equal(t, reversed, collect(reverseIter))
+	reverseIter.Close()
+
+	for _, seekKey := range []string{"", "a", "b\x00", "bac", "c\xff\xff", "\xff\xff\xff\xff\xff\xff\xff"} {
+		idx := sort.Search(len(keys), func(i int) bool {
+			return bytes.Compare([]byte(keys[i]), []byte(seekKey)) >= 0
+		})
+		iter := indexer.Iterator(false)
+		iter.Seek([]byte(seekKey))
+		assert.Equal(t, keys[idx:], collect(iter))
+		iter.Close()
+
+		ridx := sort.Search(len(reversed), func(i int) bool {
+			return bytes.Compare([]byte(reversed[i]), []byte(seekKey)) <= 0
+		})
+		reverseIter := indexer.Iterator(true)
+		reverseIter.Seek([]byte(seekKey))
+		assert.Equal(t, reversed[ridx:], collect(reverseIter))
+		reverseIter.Close()
+	}
+}
+
+func TestBTree_ApplyBatch(t *testing.T) {
+	testApplyBatch(t, NewBTree())
+}
+
+// 批量更新按顺序执行，同一个批次中的后一项可以看到前一项的结果
+func testApplyBatch(t *testing.T, indexer Indexer) {
+	indexer.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	oldPositions := indexer.ApplyBatch([]*BatchEntry{
+		{Key: []byte("a"), Pos: &data.LogRecordPos{Fid: 2, Offset: 2}},
+		{Key: []byte("b"), Pos: &data.LogRecordPos{Fid: 2, Offset: 3}},
+		{Key: []byte("b"), Delete: true},
+		{Key: []byte("c"), Delete: true},
+		{Key: []byte("d"), Pos: &data.LogRecordPos{Fid: 2, Offset: 4}},
+	})
+	assert.Equal(t, 5, len(oldPositions))
+	assert.Equal(t, int64(1), oldPositions[0].Offset)
+	assert.Nil(t, oldPositions[1])
+	assert.Equal(t, int64(3), oldPositions[2].Offset)
+	assert.Nil(t, oldPositions[3])
+	assert.Nil(t, oldPositions[4])
+
+	assert.Equal(t, 2, indexer.Size())
+	assert.Equal(t, int64(2), indexer.Get([]byte("a")).Offset)
+	assert.Nil(t, indexer.Get([]byte("b")))
+	assert.Equal(t, int64(4), indexer.Get([]byte("d")).Offset)
+}
+
+func TestBTree_MemoryUsage(t *testing.T) {
+	testMemoryUsage(t, NewBTree())
+}
+
+// 写入新的 key 增加内存占用，覆盖不变，全部删除之后回到 0
+func testMemoryUsage(t *testing.T, indexer Indexer) {
+	assert.Equal(t, int64(0), indexer.MemoryUsage())
+	indexer.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	usage := indexer.MemoryUsage()
+	assert.Greater(t, usage, int64(len("key-1")))
+	indexer.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Equal(t, usage, indexer.MemoryUsage())
+
+	indexer.ApplyBatch([]*BatchEntry{
+		{Key: []byte("key-2"), Pos: &data.LogRecordPos{Fid: 1, Offset: 3}},
+		{Key: []byte("key-3"), Pos: &data.LogRecordPos{Fid: 1, Offset: 4}},
+	})
+	assert.Equal(t, usage*3, indexer.MemoryUsage())
+
+	indexer.Delete([]byte("key-1"))
+	indexer.Delete([]byte("not-exist"))
+	indexer.ApplyBatch([]*BatchEntry{
+		{Key: []byte("key-2"), Delete: true},
+		{Key: []byte("key-3"), Delete: true},
+	})
+	assert.Equal(t, int64(0), indexer.MemoryUsage())
+}
@@ -0,0 +1,183 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// 哈希索引的分片数量，必须是 2 的幂
+const hashShardCount = 64
+
+// HashMap 哈希索引
+// 按 key 的哈希值分片存储到多个 map 中，Put/Get/Delete 的时间复杂度为 O(1)
+// key 之间没有顺序，迭代器的遍历顺序不确定，也不支持 Seek
+type HashMap struct {
+	seed   maphash.Seed
+	shards [hashShardCount]*hashShard
+	memory atomic.Int64 // 估算的内存占用
+}
+
+type hashShard struct {
+	items map[string]*data.LogRecordPos
+	lock  *sync.RWMutex
+}
+
+func NewHashMap() *HashMap {
+	h := &HashMap{seed: maphash.MakeSeed()}
+	for i := range h.shards {
+		h.shards[i] = &hashShard{
+			items: make(map[string]*data.LogRecordPos),
+			lock:  new(sync.RWMutex),
+		}
+	}
+	return h
+}
+
+func (h *HashMap) shard(key []byte) *hashShard {
+	return h.shards[maphash.Bytes(h.seed, key)&(hashShardCount-1)]
+}
+
+func (h *HashMap) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	shard := h.shard(key)
+	shard.lock.Lock()
+	oldPos, ok := shard.items[string(key)]
+	shard.items[string(key)] = pos
+	shard.lock.Unlock()
+	if !ok {
+		h.memory.Add(int64(len(key) + hashEntryOverhead))
+	}
+	return oldPos
+}
+
+func (h *HashMap) Get(key []byte) *data.LogRecordPos {
+	shard := h.shard(key)
+	shard.lock.RLock()
+	pos := shard.items[string(key)]
+	shard.lock.RUnlock()
+	return pos
+}
+
+func (h *HashMap) Delete(key []byte) (*data.LogRecordPos, bool) {
+	shard := h.shard(key)
+	shard.lock.Lock()
+	oldPos, ok := shard.items[string(key)]
+	if ok {
+		delete(shard.items, string(key))
+	}
+	shard.lock.Unlock()
+	if ok {
+		h.memory.Add(-int64(len(key) + hashEntryOverhead))
+	}
+	return oldPos, ok
+}
+
+// ApplyBatch 批量更新索引，不同的 key 位于不同的分片，逐项更新即可
+func (h *HashMap) ApplyBatch(entries []*BatchEntry) []*data.LogRecordPos {
+	return applyBatch(h, entries)
+}
+
+// EntryMemory 一个新的 key 增加的内存占用
+func (h *HashMap) EntryMemory(keySize int) int64 {
+	return int64(keySize + hashEntryOverhead)
+}
+
+// MemoryUsage 索引占用内存的估算值
+func (h *HashMap) MemoryUsage() int64 {
+	return h.memory.Load()
+}
+
+func (h *HashMap) Size() int {
+	var size int
+	for _, shard := range h.shards {
+		shard.lock.RLock()
+		size += len(shard.items)
+		shard.lock.RUnlock()
+	}
+	return size
+}
+
+// Iterator 索引迭代器
+// 遍历顺序不确定，不支持反向遍历，上层的迭代器通过 Err 返回错误；每次复制一个分片的数据，
+// 遍历过程中其他分片的修改可能被看到，也可能看不到
+func (h *HashMap) Iterator(reverse bool) Iterator {
+	return newHashIterator(h)
+}
+
+// Unordered 哈希索引是无序的
+func (h *HashMap) Unordered() bool {
+	return true
+}
+
+func (h *HashMap) Close() error {
+	return nil
+}
+
+// 哈希索引迭代器
+type hashIterator struct {
+	hash      *HashMap
+	shardIdx  int     // 当前批次对应的分片下标
+	currIndex int     // 当前批次中遍历的下标位置
+	values    []*Item // 当前分片的 key + 位置索引
+}
+
+func newHashIterator(h *HashMap) *hashIterator {
+	hi := &hashIterator{hash: h}
+	hi.Rewind()
+	return hi
+}
+
+// 从第 shardIdx 个分片开始，加载下一个非空分片的数据
+func (hi *hashIterator) loadShard(shardIdx int) {
+	hi.values = hi.values[:0]
+	hi.currIndex = 0
+	for ; shardIdx < hashShardCount; shardIdx++ {
+		shard := hi.hash.shards[shardIdx]
+		shard.lock.RLock()
+		for key, pos := range shard.items {
+			hi.values = append(hi.values, &Item{key: []byte(key), pos: pos})
+		}
+		shard.lock.RUnlock()
+		if len(hi.values) > 0 {
+			break
+		}
+	}
+	hi.shardIdx = shardIdx
+}
+
+func (hi *hashIterator) Rewind() {
+	hi.loadShard(0)
+}
+
+// Seek 哈希索引中的 key 没有顺序，不支持 Seek，调用之后迭代器失效
+func (hi *hashIterator) Seek(key []byte) {
+	hi.values = hi.values[:0]
+	hi.currIndex = 0
+	hi.shardIdx = hashShardCount
+}
+
+func (hi *hashIterator) Next() {
+	hi.currIndex += 1
+	if hi.currIndex >= len(hi.values) && hi.shardIdx < hashShardCount {
+		hi.loadShard(hi.shardIdx + 1)
+	}
+}
+
+func (hi *hashIterator) Valid() bool {
+	return hi.currIndex < len(hi.values)
+}
+
+func (hi *hashIterator) Key() []byte {
+	return hi.values[hi.currIndex].key
+}
+
+func (hi *hashIterator) Value() *data.LogRecordPos {
+	return hi.values[hi.currIndex].pos
+}
+
+func (hi *hashIterator) Close() {
+	hi.hash = nil
+	hi.values = nil
+	hi.shardIdx = hashShardCount
+}
@@ -0,0 +1,144 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestHashMap_Put(t *testing.T) {
+	hm := NewHashMap()
+	res1 := hm.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res1)
+
+	res2 := hm.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+
+	res3 := hm.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12})
+	assert.Equal(t, uint32(1), res3.Fid)
+	assert.Equal(t, int64(2), res3.Offset)
+	assert.Equal(t, 2, hm.Size())
+}
+
+func TestHashMap_Get(t *testing.T) {
+	hm := NewHashMap()
+	hm.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	pos1 := hm.Get(nil)
+	assert.Equal(t, uint32(1), pos1.Fid)
+	assert.Equal(t, int64(100), pos1.Offset)
+
+	hm.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	hm.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	pos2 := hm.Get([]byte("a"))
+	assert.Equal(t, int64(3), pos2.Offset)
+
+	assert.Nil(t, hm.Get([]byte("not exist")))
+}
+
+func TestHashMap_Delete(t *testing.T) {
+	hm := NewHashMap()
+	hm.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	res1, ok1 := hm.Delete([]byte("aaa"))
+	assert.True(t, ok1)
+	assert.Equal(t, uint32(22), res1.Fid)
+	assert.Equal(t, 0, hm.Size())
+
+	res2, ok2 := hm.Delete([]byte("aaa"))
+	assert.False(t, ok2)
+	assert.Nil(t, res2)
+}
+
+func TestHashMap_Iterator(t *testing.T) {
+	hm := NewHashMap()
+	iter1 := hm.Iterator(false)
+	assert.False(t, iter1.Valid())
+
+	var expected []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		expected = append(expected, key)
+		hm.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	iter2 := hm.Iterator(false)
+	var keys []string
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+		assert.NotNil(t, iter2.Value())
+	}
+	sort.Strings(keys)
+	assert.Equal(t, expected, keys)
+
+	// 不支持 Seek
+	iter2.Seek([]byte("key-0001"))
+	assert.False(t, iter2.Valid())
+	iter2.Close()
+}
+
+// 比较各个内存索引中每个 key 占用的内存
+func BenchmarkIndex_MemoryPerKey(b *testing.B) {
+	indexers := map[string]func() Indexer{
+		"BTree":    func() Indexer { return NewBTree() },
+		"ART":      func() Indexer { return NewART() },
+		"Hash":     func() Indexer { return NewHashMap() },
+		"SkipList": func() Indexer { return NewSkipList() },
+	}
+	const keyNum = 100000
+	for _, name := range []string{"BTree", "ART", "Hash", "SkipList"} {
+		newIndexer := indexers[name]
+		b.Run(name, func(b *testing.B) {
+			var bytesPerKey float64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				indexer := newIndexer()
+				for j := 0; j < keyNum; j++ {
+					indexer.Put([]byte(fmt.Sprintf("bitcask-key-%09d", j)), &data.LogRecordPos{Fid: 1, Offset: int64(j)})
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				bytesPerKey = float64(after.HeapAlloc-before.HeapAlloc) / keyNum
+				runtime.KeepAlive(indexer)
+			}
+			b.ReportMetric(bytesPerKey, "bytes/key")
+		})
+	}
+}
+
+func BenchmarkIndex_Get(b *testing.B) {
+	indexers := []struct {
+		name    string
+		indexer Indexer
+	}{
+		{"BTree", NewBTree()},
+		{"ART", NewART()},
+		{"Hash", NewHashMap()},
+		{"SkipList", NewSkipList()},
+	}
+	const keyNum = 100000
+	for _, idx := range indexers {
+		for j := 0; j < keyNum; j++ {
+			idx.indexer.Put([]byte(fmt.Sprintf("bitcask-key-%09d", j)), &data.LogRecordPos{Fid: 1, Offset: int64(j)})
+		}
+		b.Run(idx.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				idx.indexer.Get([]byte(fmt.Sprintf("bitcask-key-%09d", i%keyNum)))
+			}
+		})
+	}
+}
+
+func TestHashMap_ApplyBatch(t *testing.T) {
+	testApplyBatch(t, NewHashMap())
+}
+
+func TestHashMap_MemoryUsage(t *testing.T) {
+	testMemoryUsage(t, NewHashMap())
+}
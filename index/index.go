@@ -16,29 +16,91 @@ type Indexer interface {
 	Delete(key []byte) (*data.LogRecordPos, bool)
 	// Size 索引中的数据量
 	Size() int
+	// MemoryUsage 索引占用内存的估算值，字节为单位
+	MemoryUsage() int64
 	// Iterator 索引迭代器
 	Iterator(reverse bool) Iterator
+	// ApplyBatch 按顺序批量更新索引，返回每一项对应的旧位置信息
+	// 持久化的索引在一个事务中完成所有的更新
+	ApplyBatch(entries []*BatchEntry) []*data.LogRecordPos
 	// Close 关闭索引
 	Close() error
 }
 
+// SeqNoStore 能够持久化事务序列号的索引
+// 持久化的索引不会在启动时重放数据文件，需要由索引保存事务序列号
+type SeqNoStore interface {
+	// LoadSeqNo 读取持久化的事务序列号，没有保存过时返回 0
+	LoadSeqNo() (uint64, error)
+	// SaveSeqNo 持久化事务序列号，返回时已经落盘
+	SaveSeqNo(seqNo uint64) error
+}
+
+// BatchEntry 批量更新索引中的一项
+type BatchEntry struct {
+	Key    []byte
+	Pos    *data.LogRecordPos
+	Delete bool // 是否是删除，删除时忽略 Pos
+}
+
+// 逐项调用 Put 和 Delete 完成批量更新，用于单项更新已经足够高效的索引
+func applyBatch(indexer Indexer, entries []*BatchEntry) []*data.LogRecordPos {
+	oldPositions := make([]*data.LogRecordPos, len(entries))
+	for i, entry := range entries {
+		if entry.Delete {
+			oldPositions[i], _ = indexer.Delete(entry.Key)
+		} else {
+			oldPositions[i] = indexer.Put(entry.Key, entry.Pos)
+		}
+	}
+	return oldPositions
+}
+
+// 估算内存占用时每个 key 除了 key 本身之外的固定开销，包括位置索引和数据结构的节点
+// 数值来自 BenchmarkIndex_MemoryPerKey 的测量结果
+const (
+	btreeEntryOverhead    = 96
+	artEntryOverhead      = 110
+	hashEntryOverhead     = 60
+	skipListEntryOverhead = 115
+)
+
+// EntryMemory 估算向索引中写入一个新的 key 会增加多少内存占用
+// 自定义的索引可以实现 EntryMemory(keySize int) int64 方法，否则只计算 key 本身
+func EntryMemory(indexer Indexer, keySize int) int64 {
+	if e, ok := indexer.(interface{ EntryMemory(keySize int) int64 }); ok {
+		return e.EntryMemory(keySize)
+	}
+	return int64(keySize)
+}
+
+// 内存索引迭代器每次加载的数据条数
+const iteratorBatchSize = 256
+
 type IndexType = int8
 
 const (
 	Btree IndexType = iota + 1
 	ART
 	BPTree
+	Hash
+	SkipList
 )
 
 // NewIndexer 根据类型初始化索引
-func NewIndexer(indexType IndexType, dirPath string, sync bool) Indexer {
+// bloomFalsePositive 为 B+ 树索引布隆过滤器的误判率，为 0 表示不使用
+func NewIndexer(indexType IndexType, dirPath string, sync bool, bloomFalsePositive float64) Indexer {
 	switch indexType {
 	case Btree:
 		return NewBTree()
 	case ART:
 		return NewART()
 	case BPTree:
-		return NewBPlusTree(dirPath, sync)
+		return NewBPlusTree(dirPath, sync, bloomFalsePositive)
+	case Hash:
+		return NewHashMap()
+	case SkipList:
+		return NewSkipList()
 	default:
 		panic("unsupported index type")
 	}
@@ -70,3 +132,19 @@ type Iterator interface {
 	// Close 关闭迭代器，释放相应资源
 	Close()
 }
+
+// Unordered 判断索引是否是无序的，无序索引的迭代器遍历顺序不确定，也不支持 Seek
+// 自定义的索引可以实现 Unordered() bool 方法声明自己是无序的
+func Unordered(indexer Indexer) bool {
+	u, ok := indexer.(interface{ Unordered() bool })
+	return ok && u.Unordered()
+}
+
+// PersistentIndexer 持久化的索引
+// 如果索引中已经保存了所有的数据，启动时不需要从 hint 文件和数据文件中重放
+// 持久化的索引应该同时实现 SeqNoStore，否则事务序列号只能依赖关闭时保存的 seq-no 文件
+type PersistentIndexer interface {
+	Indexer
+	// Persistent 索引中的数据是否完整，返回 false 时启动时从数据文件中加载
+	Persistent() bool
+}
@@ -0,0 +1,356 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// 跳表的最大层数，每一层的概率为 1/4，足够容纳数十亿个 key
+const skipListMaxLevel = 16
+
+// ConcurrentSkipList 并发跳表索引
+// 使用 lazy skiplist 算法：查找不加锁，写入只锁住需要修改的前驱节点，
+// 不同位置的写入可以并发执行
+type ConcurrentSkipList struct {
+	head   *skipListNode
+	size   atomic.Int64
+	memory atomic.Int64 // 估算的内存占用
+}
+
+type skipListNode struct {
+	key         []byte
+	pos         atomic.Pointer[data.LogRecordPos]
+	next        []atomic.Pointer[skipListNode]
+	lock        sync.Mutex
+	marked      atomic.Bool // 是否已经被逻辑删除
+	fullyLinked atomic.Bool // 是否已经链接到所有层
+}
+
+func newSkipListNode(key []byte, pos *data.LogRecordPos, level int) *skipListNode {
+	node := &skipListNode{
+		key:  key,
+		next: make([]atomic.Pointer[skipListNode], level),
+	}
+	node.pos.Store(pos)
+	return node
+}
+
+// 节点对读取可见，即已经完全链接并且没有被删除
+func (n *skipListNode) live() bool {
+	return n.fullyLinked.Load() && !n.marked.Load()
+}
+
+func NewSkipList() *ConcurrentSkipList {
+	return &ConcurrentSkipList{
+		head: newSkipListNode(nil, nil, skipListMaxLevel),
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	return level
+}
+
+// 查找每一层中小于 key 的最后一个节点和它的后继节点，返回 key 所在的最高层，不存在时返回 -1
+func (sl *ConcurrentSkipList) find(key []byte, preds, succs []*skipListNode) int {
+	levelFound := -1
+	pred := sl.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != nil && bytes.Compare(curr.key, key) < 0 {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+		if levelFound == -1 && curr != nil && bytes.Equal(curr.key, key) {
+			levelFound = level
+		}
+		preds[level] = pred
+		succs[level] = curr
+	}
+	return levelFound
+}
+
+// 按层数从低到高锁住前驱节点，并校验前驱节点和后继节点在加锁期间没有发生变化
+// 返回已经加锁的节点，校验失败时需要重试
+func lockPreds(preds, succs []*skipListNode, topLevel int) ([]*skipListNode, bool) {
+	locked := make([]*skipListNode, 0, topLevel)
+	var prevPred *skipListNode
+	for level := 0; level < topLevel; level++ {
+		pred, succ := preds[level], succs[level]
+		if pred != prevPred {
+			pred.lock.Lock()
+			locked = append(locked, pred)
+			prevPred = pred
+		}
+		if pred.marked.Load() || (succ != nil && succ.marked.Load()) || pred.next[level].Load() != succ {
+			return locked, false
+		}
+	}
+	return locked, true
+}
+
+func unlockNodes(nodes []*skipListNode) {
+	for _, node := range nodes {
+		node.lock.Unlock()
+	}
+}
+
+func (sl *ConcurrentSkipList) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	topLevel := randomLevel()
+	var preds, succs [skipListMaxLevel]*skipListNode
+	for {
+		levelFound := sl.find(key, preds[:], succs[:])
+		if levelFound != -1 {
+			node := succs[levelFound]
+			// 等待并发插入完成
+			for !node.fullyLinked.Load() && !node.marked.Load() {
+				runtime.Gosched()
+			}
+			// 加锁保证更新时节点没有被并发删除
+			node.lock.Lock()
+			if node.marked.Load() {
+				node.lock.Unlock()
+				continue
+			}
+			oldPos := node.pos.Swap(pos)
+			node.lock.Unlock()
+			return oldPos
+		}
+
+		locked, valid := lockPreds(preds[:], succs[:], topLevel)
+		if !valid {
+			unlockNodes(locked)
+			continue
+		}
+		node := newSkipListNode(key, pos, topLevel)
+		for level := 0; level < topLevel; level++ {
+			node.next[level].Store(succs[level])
+		}
+		for level := 0; level < topLevel; level++ {
+			preds[level].next[level].Store(node)
+		}
+		node.fullyLinked.Store(true)
+		unlockNodes(locked)
+		sl.size.Add(1)
+		sl.memory.Add(int64(len(key) + skipListEntryOverhead))
+		return nil
+	}
+}
+
+func (sl *ConcurrentSkipList) Get(key []byte) *data.LogRecordPos {
+	node := sl.findGreaterOrEqual(key)
+	if node == nil || !bytes.Equal(node.key, key) {
+		return nil
+	}
+	return node.pos.Load()
+}
+
+func (sl *ConcurrentSkipList) Delete(key []byte) (*data.LogRecordPos, bool) {
+	var preds, succs [skipListMaxLevel]*skipListNode
+	var victim *skipListNode
+	isMarked := false
+	for {
+		levelFound := sl.find(key, preds[:], succs[:])
+		if !isMarked {
+			if levelFound == -1 {
+				return nil, false
+			}
+			victim = succs[levelFound]
+			// 只有完全链接、并且在最高层找到的节点才能删除
+			if !victim.fullyLinked.Load() || len(victim.next)-1 != levelFound || victim.marked.Load() {
+				return nil, false
+			}
+			victim.lock.Lock()
+			if victim.marked.Load() {
+				victim.lock.Unlock()
+				return nil, false
+			}
+			// 逻辑删除，之后其他的读写操作都不会再看到这个节点
+			victim.marked.Store(true)
+			isMarked = true
+		}
+
+		topLevel := len(victim.next)
+		locked := make([]*skipListNode, 0, topLevel)
+		var prevPred *skipListNode
+		valid := true
+		for level := 0; valid && level < topLevel; level++ {
+			pred := preds[level]
+			if pred != prevPred {
+				pred.lock.Lock()
+				locked = append(locked, pred)
+				prevPred = pred
+			}
+			valid = !pred.marked.Load() && pred.next[level].Load() == victim
+		}
+		if !valid {
+			unlockNodes(locked)
+			continue
+		}
+		// 物理删除，被删除节点的后继指针保持不变，正在遍历的迭代器可以继续向后遍历
+		for level := topLevel - 1; level >= 0; level-- {
+			preds[level].next[level].Store(victim.next[level].Load())
+		}
+		victim.lock.Unlock()
+		unlockNodes(locked)
+		sl.size.Add(-1)
+		sl.memory.Add(-int64(len(key) + skipListEntryOverhead))
+		return victim.pos.Load(), true
+	}
+}
+
+// ApplyBatch 批量更新索引，跳表的写入只锁住局部的节点，逐项更新即可
+func (sl *ConcurrentSkipList) ApplyBatch(entries []*BatchEntry) []*data.LogRecordPos {
+	return applyBatch(sl, entries)
+}
+
+// EntryMemory 一个新的 key 增加的内存占用
+func (sl *ConcurrentSkipList) EntryMemory(keySize int) int64 {
+	return int64(keySize + skipListEntryOverhead)
+}
+
+// MemoryUsage 索引占用内存的估算值
+func (sl *ConcurrentSkipList) MemoryUsage() int64 {
+	return sl.memory.Load()
+}
+
+func (sl *ConcurrentSkipList) Size() int {
+	return int(sl.size.Load())
+}
+
+// Iterator 索引迭代器
+// 迭代器直接在跳表上遍历，不需要复制数据，遍历过程中其他的写入可能被看到，也可能看不到，
+// 但遍历始终是有序的，并且不会重复返回同一个 key
+func (sl *ConcurrentSkipList) Iterator(reverse bool) Iterator {
+	sli := &skipListIterator{
+		list:    sl,
+		reverse: reverse,
+	}
+	sli.Rewind()
+	return sli
+}
+
+func (sl *ConcurrentSkipList) Close() error {
+	return nil
+}
+
+// 查找第一个大于等于 key 的有效节点
+func (sl *ConcurrentSkipList) findGreaterOrEqual(key []byte) *skipListNode {
+	pred := sl.head
+	var curr *skipListNode
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		curr = pred.next[level].Load()
+		for curr != nil && bytes.Compare(curr.key, key) < 0 {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+	}
+	return skipToLive(curr)
+}
+
+// 查找最后一个小于 key 的有效节点
+func (sl *ConcurrentSkipList) findLess(key []byte) *skipListNode {
+	return sl.findLast(func(nodeKey []byte) bool {
+		return bytes.Compare(nodeKey, key) < 0
+	})
+}
+
+// 查找最后一个满足 less 的有效节点，less 为 nil 时查找最后一个有效节点
+func (sl *ConcurrentSkipList) findLast(less func(nodeKey []byte) bool) *skipListNode {
+	for {
+		pred := sl.head
+		for level := skipListMaxLevel - 1; level >= 0; level-- {
+			curr := pred.next[level].Load()
+			for curr != nil && (less == nil || less(curr.key)) {
+				pred = curr
+				curr = pred.next[level].Load()
+			}
+		}
+		if pred == sl.head {
+			return nil
+		}
+		if pred.live() {
+			return pred
+		}
+		// 前驱节点正在插入或者已经被删除，继续向前查找
+		key := pred.key
+		less = func(nodeKey []byte) bool {
+			return bytes.Compare(nodeKey, key) < 0
+		}
+	}
+}
+
+// 从 node 开始沿着最底层向后查找第一个有效的节点
+func skipToLive(node *skipListNode) *skipListNode {
+	for node != nil && !node.live() {
+		node = node.next[0].Load()
+	}
+	return node
+}
+
+// 跳表索引迭代器
+type skipListIterator struct {
+	list    *ConcurrentSkipList
+	reverse bool
+	curr    *skipListNode // 当前遍历到的节点
+	pos     *data.LogRecordPos
+}
+
+func (sli *skipListIterator) setCurr(node *skipListNode) {
+	sli.curr = node
+	if node != nil {
+		sli.pos = node.pos.Load()
+	}
+}
+
+func (sli *skipListIterator) Rewind() {
+	if sli.reverse {
+		sli.setCurr(sli.list.findLast(nil))
+		return
+	}
+	sli.setCurr(skipToLive(sli.list.head.next[0].Load()))
+}
+
+func (sli *skipListIterator) Seek(key []byte) {
+	node := sli.list.findGreaterOrEqual(key)
+	if sli.reverse && (node == nil || !bytes.Equal(node.key, key)) {
+		node = sli.list.findLess(key)
+	}
+	sli.setCurr(node)
+}
+
+func (sli *skipListIterator) Next() {
+	if sli.curr == nil {
+		return
+	}
+	if sli.reverse {
+		sli.setCurr(sli.list.findLess(sli.curr.key))
+		return
+	}
+	sli.setCurr(skipToLive(sli.curr.next[0].Load()))
+}
+
+func (sli *skipListIterator) Valid() bool {
+	return sli.curr != nil
+}
+
+func (sli *skipListIterator) Key() []byte {
+	return sli.curr.key
+}
+
+func (sli *skipListIterator) Value() *data.LogRecordPos {
+	return sli.pos
+}
+
+func (sli *skipListIterator) Close() {
+	sli.list = nil
+	sli.curr = nil
+	sli.pos = nil
+}
@@ -0,0 +1,125 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentSkipList_Put(t *testing.T) {
+	sl := NewSkipList()
+	res1 := sl.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res1)
+
+	res2 := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+
+	res3 := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12})
+	assert.Equal(t, uint32(1), res3.Fid)
+	assert.Equal(t, int64(2), res3.Offset)
+	assert.Equal(t, 2, sl.Size())
+}
+
+func TestConcurrentSkipList_Get(t *testing.T) {
+	sl := NewSkipList()
+	sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	pos := sl.Get([]byte("a"))
+	assert.Equal(t, int64(3), pos.Offset)
+
+	assert.Nil(t, sl.Get([]byte("b")))
+	assert.Nil(t, sl.Get([]byte("")))
+}
+
+func TestConcurrentSkipList_Delete(t *testing.T) {
+	sl := NewSkipList()
+	sl.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	res1, ok1 := sl.Delete([]byte("aaa"))
+	assert.True(t, ok1)
+	assert.Equal(t, uint32(22), res1.Fid)
+	assert.Equal(t, 0, sl.Size())
+	assert.Nil(t, sl.Get([]byte("aaa")))
+
+	res2, ok2 := sl.Delete([]byte("aaa"))
+	assert.False(t, ok2)
+	assert.Nil(t, res2)
+}
+
+func TestConcurrentSkipList_Iterator(t *testing.T) {
+	sl := NewSkipList()
+	iter := sl.Iterator(false)
+	assert.False(t, iter.Valid())
+	testIteratorOrder(t, sl)
+}
+
+// 遍历过程中删除当前节点，迭代器仍然可以继续有序遍历
+func TestConcurrentSkipList_Iterator_Delete(t *testing.T) {
+	sl := NewSkipList()
+	for i := 0; i < 100; i++ {
+		sl.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter := sl.Iterator(false)
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		sl.Delete(iter.Key())
+	}
+	assert.Equal(t, 100, len(keys))
+	assert.Equal(t, "key-099", keys[99])
+	assert.Equal(t, 0, sl.Size())
+	iter.Close()
+}
+
+func TestConcurrentSkipList_Concurrent(t *testing.T) {
+	sl := NewSkipList()
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%04d", g, i))
+				sl.Put(key, &data.LogRecordPos{Fid: uint32(g), Offset: int64(i)})
+				if i%2 == 0 {
+					sl.Delete(key)
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			var prev []byte
+			iter := sl.Iterator(false)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				assert.True(t, prev == nil || string(prev) < string(iter.Key()))
+				prev = iter.Key()
+			}
+			iter.Close()
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 8*500, sl.Size())
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 1000; i++ {
+			pos := sl.Get([]byte(fmt.Sprintf("key-%d-%04d", g, i)))
+			if i%2 == 0 {
+				assert.Nil(t, pos)
+			} else {
+				assert.Equal(t, int64(i), pos.Offset)
+			}
+		}
+	}
+}
+
+func TestConcurrentSkipList_ApplyBatch(t *testing.T) {
+	testApplyBatch(t, NewSkipList())
+}
+
+func TestConcurrentSkipList_MemoryUsage(t *testing.T) {
+	testMemoryUsage(t, NewSkipList())
+}
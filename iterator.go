@@ -7,41 +7,119 @@ import (
 
 // Iterator 迭代器
 type Iterator struct {
-	indexIter index.Iterator
-	db        *DB
-	options   IteratorOptions
+	indexIter  index.Iterator
+	db         *DB
+	options    IteratorOptions
+	lowerBound []byte // 结合前缀和下界计算出的实际下界（包含），nil 表示没有下界
+	upperBound []byte // 结合前缀和上界计算出的实际上界（不包含），nil 表示没有上界
+	unordered  bool   // 索引是否是无序的，无序时需要逐个过滤范围之外的key
+	err        error  // 迭代器因为不支持的操作而失效的原因
 }
 
 func (db *DB) NewIterator(options IteratorOptions) *Iterator {
+	db.mu.RLock()
 	indexIter := db.index.Iterator(options.Reverse)
-	return &Iterator{
-		indexIter: indexIter,
-		db:        db,
-		options:   options,
+	unordered := index.Unordered(db.index)
+	db.mu.RUnlock()
+	it := &Iterator{
+		indexIter:  indexIter,
+		db:         db,
+		options:    options,
+		lowerBound: options.LowerBound,
+		upperBound: options.UpperBound,
+		unordered:  unordered,
 	}
+	// 前缀等价于 [prefix, prefix的后继) 的区间，和用户指定的上下界取交集
+	if len(options.Prefix) > 0 {
+		if it.lowerBound == nil || bytes.Compare(options.Prefix, it.lowerBound) > 0 {
+			it.lowerBound = options.Prefix
+		}
+		if successor := prefixSuccessor(options.Prefix); successor != nil &&
+			(it.upperBound == nil || bytes.Compare(successor, it.upperBound) < 0) {
+			it.upperBound = successor
+		}
+	}
+	// 索引迭代器创建时位于起点，有边界或者不支持反向遍历时需要重新定位
+	if it.lowerBound != nil || it.upperBound != nil || (unordered && options.Reverse) {
+		it.Rewind()
+	}
+	return it
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
+// 正向遍历时直接定位到下界，反向遍历时直接定位到上界之前的最后一个key
+// 无序索引不支持反向遍历，迭代器始终无效，Err 返回 ErrReverseUnsupported
 func (it *Iterator) Rewind() {
+	it.err = nil
+	if it.unordered {
+		if it.options.Reverse {
+			it.err = ErrReverseUnsupported
+			return
+		}
+		it.indexIter.Rewind()
+		it.skipOutOfBounds()
+		return
+	}
+	if it.options.Reverse {
+		if it.upperBound != nil {
+			it.seekBeforeUpperBound()
+			return
+		}
+	} else if it.lowerBound != nil {
+		it.indexIter.Seek(it.lowerBound)
+		return
+	}
 	it.indexIter.Rewind()
-	it.skipToNext()
 }
 
 // Seek 根据传入的key查找到第一个大于（或小于）等于的目标key， 根据从这个key开始遍历
+// 传入的key超出了遍历范围时，会被限制在范围之内
+// 无序索引不支持 Seek，调用之后迭代器失效，Err 返回 ErrSeekUnsupported
 func (it *Iterator) Seek(key []byte) {
+	if it.unordered {
+		it.err = ErrSeekUnsupported
+		return
+	}
+	if it.options.Reverse {
+		if it.upperBound != nil && bytes.Compare(key, it.upperBound) >= 0 {
+			it.seekBeforeUpperBound()
+			return
+		}
+	} else if it.lowerBound != nil && bytes.Compare(key, it.lowerBound) < 0 {
+		key = it.lowerBound
+	}
 	it.indexIter.Seek(key)
-	it.skipToNext()
 }
 
 // Next 跳转到下一个key
 func (it *Iterator) Next() {
 	it.indexIter.Next()
-	it.skipToNext()
+	if it.unordered {
+		it.skipOutOfBounds()
+	}
 }
 
 // Valid 是否有效，即是否已经遍历完了所有的key，用于退出遍历
+// 如果迭代器的上下文被取消，或者已经越过了遍历范围的边界，也会返回false
 func (it *Iterator) Valid() bool {
-	return it.indexIter.Valid()
+	if it.Err() != nil {
+		return false
+	}
+	if !it.indexIter.Valid() {
+		return false
+	}
+	return it.inBounds(it.indexIter.Key())
+}
+
+// Err 返回迭代器因上下文被取消或者不支持的操作而终止的原因，正常遍历结束时返回nil
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.options.Context == nil {
+		return nil
+	}
+	return it.options.Context.Err()
 }
 
 // Key 当前遍历位置的key数据
@@ -62,16 +140,45 @@ func (it *Iterator) Close() {
 	it.indexIter.Close()
 }
 
-func (it *Iterator) skipToNext() {
-	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
+// 反向遍历时定位到小于上界的最后一个key
+func (it *Iterator) seekBeforeUpperBound() {
+	it.indexIter.Seek(it.upperBound)
+	// 上界不包含在遍历范围内
+	if it.indexIter.Valid() && bytes.Equal(it.indexIter.Key(), it.upperBound) {
+		it.indexIter.Next()
+	}
+}
+
+// 无序索引中范围之内的key不是连续的，跳过范围之外的key
+func (it *Iterator) skipOutOfBounds() {
+	if it.lowerBound == nil && it.upperBound == nil {
 		return
 	}
+	for it.indexIter.Valid() && !it.inBounds(it.indexIter.Key()) {
+		it.indexIter.Next()
+	}
+}
+
+// 判断key是否在 [lowerBound, upperBound) 的范围之内
+func (it *Iterator) inBounds(key []byte) bool {
+	if it.lowerBound != nil && bytes.Compare(key, it.lowerBound) < 0 {
+		return false
+	}
+	if it.upperBound != nil && bytes.Compare(key, it.upperBound) >= 0 {
+		return false
+	}
+	return true
+}
 
-	for ; it.indexIter.Valid(); it.indexIter.Next() {
-		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
-			break
+// 获取大于所有以prefix为前缀的key的最小key，prefix全部为0xff时不存在，返回nil
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			successor := make([]byte, i+1)
+			copy(successor, prefix[:i+1])
+			successor[i]++
+			return successor
 		}
 	}
+	return nil
 }
@@ -2,6 +2,7 @@ package bitcask_go
 
 import (
 	"bitcask-go/utils"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
@@ -101,3 +102,149 @@ func TestDB_Iterator_Multi_Value(t *testing.T) {
 	}
 	iter3.Close()
 }
+
+func TestDB_Iterator_Context(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-ctx")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Context = ctx
+	iter := db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+		if count == 10 {
+			cancel()
+		}
+	}
+	assert.Equal(t, 10, count)
+	assert.Equal(t, context.Canceled, iter.Err())
+}
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	indexTypes := []IndexerType{BTree, ART, BPlusTree, SkipList}
+	for _, indexType := range indexTypes {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-bounds")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for _, key := range []string{"a", "ab", "abc", "abd", "ac", "b", "ba", "c"} {
+			err := db.Put([]byte(key), []byte(key))
+			assert.Nil(t, err)
+		}
+
+		collect := func(iterOpts IteratorOptions) []string {
+			iter := db.NewIterator(iterOpts)
+			defer iter.Close()
+			var keys []string
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			return keys
+		}
+
+		// 上下界
+		iterOpts := DefaultIteratorOptions
+		iterOpts.LowerBound = []byte("ab")
+		iterOpts.UpperBound = []byte("b")
+		assert.Equal(t, []string{"ab", "abc", "abd", "ac"}, collect(iterOpts))
+		iterOpts.Reverse = true
+		assert.Equal(t, []string{"ac", "abd", "abc", "ab"}, collect(iterOpts))
+
+		// 前缀
+		iterOpts = DefaultIteratorOptions
+		iterOpts.Prefix = []byte("ab")
+		assert.Equal(t, []string{"ab", "abc", "abd"}, collect(iterOpts))
+		iterOpts.Reverse = true
+		assert.Equal(t, []string{"abd", "abc", "ab"}, collect(iterOpts))
+
+		// 前缀和上下界取交集
+		iterOpts = DefaultIteratorOptions
+		iterOpts.Prefix = []byte("a")
+		iterOpts.LowerBound = []byte("abd")
+		assert.Equal(t, []string{"abd", "ac"}, collect(iterOpts))
+
+		// Seek 被限制在范围之内
+		iterOpts = DefaultIteratorOptions
+		iterOpts.Prefix = []byte("b")
+		iterOpts.Reverse = true
+		iter := db.NewIterator(iterOpts)
+		iter.Seek([]byte("z"))
+		assert.True(t, iter.Valid())
+		assert.Equal(t, []byte("ba"), iter.Key())
+		iter.Next()
+		iter.Next()
+		assert.False(t, iter.Valid())
+		iter.Close()
+
+		destroyDB(db)
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	assert.Equal(t, []byte("b"), prefixSuccessor([]byte("a")))
+	assert.Equal(t, []byte("ab"), prefixSuccessor([]byte("aa\xff")))
+	assert.Nil(t, prefixSuccessor([]byte("\xff\xff")))
+}
+
+func TestDB_Iterator_Hash(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-hash")
+	opts.DirPath = dir
+	opts.IndexType = Hash
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"a", "ab", "abc", "abd", "ac", "b", "ba", "c"} {
+		err := db.Put([]byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	// 无序索引按范围过滤
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Prefix = []byte("ab")
+	iter := db.NewIterator(iterOpts)
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.ElementsMatch(t, []string{"ab", "abc", "abd"}, keys)
+	assert.Nil(t, iter.Err())
+
+	// 不支持 Seek
+	iter.Seek([]byte("abc"))
+	assert.False(t, iter.Valid())
+	assert.Equal(t, ErrSeekUnsupported, iter.Err())
+	iter.Close()
+
+	// 不支持反向遍历
+	iterOpts.Reverse = true
+	iter = db.NewIterator(iterOpts)
+	assert.False(t, iter.Valid())
+	assert.Equal(t, ErrReverseUnsupported, iter.Err())
+	iter.Rewind()
+	assert.False(t, iter.Valid())
+	assert.Equal(t, ErrReverseUnsupported, iter.Err())
+	iter.Close()
+}
@@ -0,0 +1,215 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// 当前的磁盘数据格式版本，数据文件、hint 文件等格式发生不兼容的变化时需要递增
+	currentFormatVersion uint32 = 1
+	manifestKey                 = "manifest"
+)
+
+// manifest 数据目录的元信息
+// 记录创建数据目录时使用的格式版本和配置项，以及当前有效的数据文件
+type manifest struct {
+	FormatVersion uint32      `json:"format_version"`
+	IndexType     IndexerType `json:"index_type"`
+	DataFileSize  int64       `json:"data_file_size"`
+	FileIds       []uint32    `json:"file_ids"`
+	// 自定义索引是否持久化在磁盘上，其他类型的索引由 IndexType 决定
+	PersistentIndex bool `json:"persistent_index,omitempty"`
+}
+
+// 数据目录中是否有持久化的索引
+func (m *manifest) persistentIndex() bool {
+	return m.IndexType == BPlusTree || (m.IndexType == Custom && m.PersistentIndex)
+}
+
+// 读取数据目录中的 MANIFEST 文件，文件不存在时返回 nil
+func readManifest(fs fio.FileSystem, dirPath string) (*manifest, error) {
+	fileName := filepath.Join(dirPath, data.ManifestFileName)
+	if _, err := fs.Stat(fileName); os.IsNotExist(err) {
+		return nil, nil
+	}
+	manifestFile, err := data.OpenManifestFile(fs, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = manifestFile.Close()
+	}()
+
+	record, _, err := manifestFile.ReadLogRecord(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: read manifest: %v", ErrManifestCorrupted, err)
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(record.Value, m); err != nil {
+		return nil, fmt.Errorf("%w: decode manifest: %v", ErrManifestCorrupted, err)
+	}
+	return m, nil
+}
+
+// 校验 MANIFEST 和用户传入的配置项是否兼容，需要在创建索引之前调用
+func checkManifest(m *manifest, options Options) error {
+	if m.FormatVersion > currentFormatVersion {
+		return fmt.Errorf("%w: directory format version is %d, the supported version is %d",
+			ErrUnsupportedFormatVersion, m.FormatVersion, currentFormatVersion)
+	}
+	// 内存索引每次启动都从数据文件重建，相互之间可以直接切换
+	// 持久化的索引切换时需要重建，自定义索引在创建之前无法知道是否持久化，按照持久化的处理
+	persistent := m.persistentIndex() || options.IndexType == BPlusTree || options.IndexType == Custom
+	if m.IndexType != options.IndexType && persistent {
+		return fmt.Errorf("%w: directory was created with %s index, but opened with %s index",
+			ErrIndexTypeMismatch, indexTypeName(m.IndexType), indexTypeName(options.IndexType))
+	}
+	// DataFileSize 只决定数据文件写到多大时切换，已有的数据文件保持原来的大小，可以直接读取，允许修改
+	// 修改之后的值在打开完成时由 writeManifest 写入 MANIFEST；改小时超过新大小的活跃文件在下一次写入时切换
+	return nil
+}
+
+// 没有 MANIFEST 的旧数据目录，根据目录中的文件推断创建时使用的索引类型
+func checkLegacyDirectory(options Options) error {
+	entries, err := options.FileSystem.ReadDir(options.DirPath)
+	if err != nil {
+		return err
+	}
+	var hasDataFile, hasBPTreeIndex bool
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			hasDataFile = true
+		}
+		if entry.Name() == index.BPTreeIndexFileName {
+			hasBPTreeIndex = true
+		}
+	}
+	if hasBPTreeIndex && options.IndexType != BPlusTree {
+		return fmt.Errorf("%w: directory was created with %s index, but opened with %s index",
+			ErrIndexTypeMismatch, indexTypeName(BPlusTree), indexTypeName(options.IndexType))
+	}
+	if !hasBPTreeIndex && hasDataFile && options.IndexType == BPlusTree {
+		return fmt.Errorf("%w: directory has no %s file, but opened with %s index",
+			ErrIndexTypeMismatch, index.BPTreeIndexFileName, indexTypeName(BPlusTree))
+	}
+	return nil
+}
+
+// 校验 MANIFEST 中记录的数据文件是否都存在
+// 发生过 merge 时，小于 nonMergeFileId 的文件已经被 merge 后的文件替换，不再校验
+func (db *DB) checkManifestFiles(m *manifest) error {
+	var nonMergeFileId uint32
+	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := db.fs.Stat(mergeFinFileName); err == nil {
+		fid, err := db.getNonMergeFileId(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		nonMergeFileId = fid
+	}
+
+	for _, fid := range m.FileIds {
+		if fid < nonMergeFileId {
+			continue
+		}
+		if db.activeFile != nil && db.activeFile.FileId == fid {
+			continue
+		}
+		if _, ok := db.olderFiles[fid]; !ok {
+			return fmt.Errorf("%w: data file %s recorded in manifest is missing",
+				ErrDataDirectoryCorrupted, filepath.Base(data.GetDataFileName(db.options.DirPath, fid)))
+		}
+	}
+	return nil
+}
+
+// 将当前数据目录的元信息写入 MANIFEST
+// 在访问此方法时必须持有互斥锁
+func (db *DB) writeManifest() error {
+	fileIds := make([]uint32, 0, len(db.olderFiles)+1)
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, fid)
+	}
+	if db.activeFile != nil {
+		fileIds = append(fileIds, db.activeFile.FileId)
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+
+	// 实现了 PersistentIndexer 的自定义索引会在磁盘上保存数据
+	_, persistent := db.index.(index.PersistentIndexer)
+	return writeManifestFile(db.fs, db.options.DirPath, &manifest{
+		FormatVersion:   currentFormatVersion,
+		IndexType:       db.options.IndexType,
+		DataFileSize:    db.options.DataFileSize,
+		FileIds:         fileIds,
+		PersistentIndex: db.options.IndexType == Custom && persistent,
+	})
+}
+
+// 将 MANIFEST 写入数据目录
+// 先写入临时文件再重命名，保证 MANIFEST 始终是完整的
+func writeManifestFile(fs fio.FileSystem, dirPath string, m *manifest) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(manifestKey),
+		Value: value,
+	})
+
+	// 删除上次没有完成的临时文件
+	tempFileName := filepath.Join(dirPath, data.ManifestTempFileName)
+	if err := fs.Remove(tempFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tempFile, err := data.OpenManifestTempFile(fs, dirPath)
+	if err != nil {
+		return err
+	}
+	if err := tempFile.Write(encRecord); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tempFileName, filepath.Join(dirPath, data.ManifestFileName)); err != nil {
+		return err
+	}
+	// 持久化目录，保证重命名在掉电之后不会丢失
+	return fs.SyncDir(dirPath)
+}
+
+func indexTypeName(indexType IndexerType) string {
+	switch indexType {
+	case BTree:
+		return "BTree"
+	case ART:
+		return "ART"
+	case BPlusTree:
+		return "BPlusTree"
+	case Hash:
+		return "Hash"
+	case SkipList:
+		return "SkipList"
+	case Custom:
+		return "Custom"
+	default:
+		return fmt.Sprintf("unknown(%d)", indexType)
+	}
+}
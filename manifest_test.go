@@ -0,0 +1,177 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Manifest(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+
+	m, err := readManifest(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+	assert.Equal(t, currentFormatVersion, m.FormatVersion)
+	assert.Equal(t, BTree, m.IndexType)
+	assert.Equal(t, opts.DataFileSize, m.DataFileSize)
+	assert.Equal(t, len(db.olderFiles)+1, len(m.FileIds))
+	assert.Equal(t, db.activeFile.FileId, m.FileIds[len(m.FileIds)-1])
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 内存索引之间可以直接切换
+	opts2 := opts
+	opts2.IndexType = ART
+	db1, err := Open(opts2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db1.ListKeys()))
+	err = db1.Close()
+	assert.Nil(t, err)
+	m1, err := readManifest(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, ART, m1.IndexType)
+
+	// 切换到持久化的索引需要转换
+	opts2.IndexType = BPlusTree
+	_, err = Open(opts2)
+	assert.True(t, errors.Is(err, ErrIndexTypeMismatch))
+
+	// 修改 DataFileSize 是允许的，MANIFEST 记录新的值
+	opts3 := opts
+	opts3.DataFileSize = 64 * 1024
+	db2, err := Open(opts3)
+	assert.Nil(t, err)
+	assert.NotNil(t, db2)
+	m2, err := readManifest(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, opts3.DataFileSize, m2.DataFileSize)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 改小之后，超过新大小的活跃文件在下一次写入时切换
+	opts3.DataFileSize = 1024
+	db3, err := Open(opts3)
+	assert.Nil(t, err)
+	activeFileId := db3.activeFile.FileId
+	assert.Nil(t, db3.Put(utils.GetTestKey(1000), utils.RandomValue(128)))
+	assert.Equal(t, activeFileId+1, db3.activeFile.FileId)
+	assert.Equal(t, 1001, len(db3.ListKeys()))
+	err = db3.Close()
+	assert.Nil(t, err)
+	m3, err := readManifest(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, opts3.DataFileSize, m3.DataFileSize)
+
+	// 记录的数据文件丢失
+	err = os.Remove(data.GetDataFileName(dir, m.FileIds[0]))
+	assert.Nil(t, err)
+	_, err = Open(opts)
+	assert.True(t, errors.Is(err, ErrDataDirectoryCorrupted))
+
+	_ = os.RemoveAll(dir)
+}
+
+func TestDB_Manifest_UnsupportedVersion(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest-version")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 写入一个更高版本的 MANIFEST
+	m, err := readManifest(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	m.FormatVersion = currentFormatVersion + 1
+	err = writeManifestFile(fio.OSFileSystem, dir, m)
+	assert.Nil(t, err)
+
+	_, err = Open(opts)
+	assert.True(t, errors.Is(err, ErrUnsupportedFormatVersion))
+
+	_ = os.RemoveAll(dir)
+}
+
+func TestDB_Manifest_Legacy(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-manifest-legacy")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 模拟没有 MANIFEST 的旧数据目录
+	err = os.Remove(filepath.Join(dir, data.ManifestFileName))
+	assert.Nil(t, err)
+
+	// 旧数据目录没有 B+ 树索引文件，不能用 B+ 树索引打开
+	opts2 := opts
+	opts2.IndexType = BPlusTree
+	_, err = Open(opts2)
+	assert.True(t, errors.Is(err, ErrIndexTypeMismatch))
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.NotNil(t, db2)
+	assert.Equal(t, 100, len(db2.ListKeys()))
+
+	// 打开之后完成升级
+	m, err := readManifest(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+	assert.Equal(t, []uint32{0}, m.FileIds)
+}
+
+func TestCheckManifest_IndexType(t *testing.T) {
+	cases := []struct {
+		dirIndex   IndexerType
+		persistent bool
+		openIndex  IndexerType
+		mismatch   bool
+	}{
+		{BTree, false, BTree, false},
+		{BTree, false, ART, false},
+		{Hash, false, SkipList, false},
+		{Custom, false, BTree, false},
+		{BTree, false, BPlusTree, true},
+		{BPlusTree, false, ART, true},
+		{Custom, true, BTree, true},
+		{BTree, false, Custom, true},
+	}
+	for _, c := range cases {
+		m := &manifest{FormatVersion: currentFormatVersion, IndexType: c.dirIndex, PersistentIndex: c.persistent}
+		opts := DefaultOptions
+		opts.IndexType = c.openIndex
+		err := checkManifest(m, opts)
+		assert.Equal(t, c.mismatch, errors.Is(err, ErrIndexTypeMismatch),
+			"%s -> %s", indexTypeName(c.dirIndex), indexTypeName(c.openIndex))
+	}
+}
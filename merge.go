@@ -2,23 +2,39 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
-	"bitcask-go/utils"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"context"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 const mergeDirName = "-merge"
 const mergeFinishedKey = "merge.finished"
 
+// 开始将 merge 目录中的文件移动到数据目录中时创建的标识文件，存在时说明旧的数据文件已经删除
+const mergeInstallingFileName = "merge-installing"
+
 // Merge 清零无效数据，生成Hint文件
 func (db *DB) Merge() error {
+	return db.MergeContext(context.Background())
+}
+
+// MergeContext 清理无效数据，生成Hint文件
+// ctx 被取消时尽快停止，并删除未完成的merge目录，数据目录保持不变
+func (db *DB) MergeContext(ctx context.Context) error {
 	if db.activeFile == nil {
 		return nil
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	db.mu.Lock()
 	// 如果merge正在进行当中，则直接返回
 	if db.isMerging {
@@ -27,7 +43,7 @@ func (db *DB) Merge() error {
 	}
 
 	// 查看可以merge的数量是否达到了阈值
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.dataDirSize()
 	if err != nil {
 		db.mu.Unlock()
 		return err
@@ -38,7 +54,7 @@ func (db *DB) Merge() error {
 	}
 
 	// 查看剩余的空间容量是否可以容纳merge之后的数据量
-	availableDishSize, err := utils.AvailableDishSize()
+	availableDishSize, err := db.fs.AvailableSize(db.options.DirPath)
 	if err != nil {
 		db.mu.Unlock()
 		return err
@@ -52,18 +68,17 @@ func (db *DB) Merge() error {
 	defer func() {
 		db.isMerging = false
 	}()
+	start := time.Now()
 
 	// 持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
+	if err := db.syncActiveFile(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	// 将当前活跃文件转换为旧的数据文件
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	// 打开新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
+	// 将当前活跃文件转换为旧的数据文件，并打开新的活跃文件
+	if err := db.rotateActiveDataFile(); err != nil {
 		db.mu.Unlock()
-		return nil
+		return err
 	}
 	// 记录最近没有参与merge的文件id
 	nonMergeFileId := db.activeFile.FileId
@@ -72,6 +87,7 @@ func (db *DB) Merge() error {
 	for _, file := range db.olderFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
+	reclaimSize := db.reclaimSize
 	// 提前释放锁
 	db.mu.Unlock()
 
@@ -79,89 +95,236 @@ func (db *DB) Merge() error {
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
+	mergeFileIds := make([]uint32, len(mergeFiles))
+	for i, file := range mergeFiles {
+		mergeFileIds[i] = file.FileId
+	}
+	db.listener.OnMergeStart(MergeStartInfo{
+		MergeFileIds:    mergeFileIds,
+		NonMergeFileId:  nonMergeFileId,
+		TotalSize:       totalSize,
+		ReclaimableSize: reclaimSize,
+	})
+
+	// merge 开始之后的任何错误都需要通知监听器
+	reclaimed, err := db.mergeDataFiles(ctx, mergeFiles, nonMergeFileId)
+	if err == nil {
+		err = db.refreshAfterMerge()
+	}
+	if err != nil {
+		db.listener.OnMergeFailed(MergeFailedInfo{
+			Err:      err,
+			Duration: time.Since(start),
+		})
+		return err
+	}
+
+	// 记录 merge 的耗时和回收的空间
+	duration := time.Since(start)
+	if reclaimed > 0 {
+		atomic.AddUint64(&db.metrics.mergeReclaimedBytes, uint64(reclaimed))
+	}
+	atomic.AddUint64(&db.metrics.merges, 1)
+	db.metrics.mergeDuration.observe(duration)
+	db.listener.OnMergeFinish(MergeFinishInfo{
+		MergeFileIds:   mergeFileIds,
+		NonMergeFileId: nonMergeFileId,
+		ReclaimedBytes: reclaimed,
+		Duration:       duration,
+	})
+	return nil
+}
+
+// merge 完成之后更新 value 缓存、磁盘占用和布隆过滤器
+func (db *DB) refreshAfterMerge() error {
+	// merge 之后的数据文件在下次启动时替换旧的数据文件，位置会发生变化，清空 value 缓存
+	if db.valueCache != nil {
+		db.valueCache.clear()
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// merge 目录占用了磁盘空间，重新统计剩余空间
+	if err := db.refreshDiskUsage(); err != nil {
+		return err
+	}
+
+	// merge 回收的通常是被删除和覆盖的数据，重建布隆过滤器去掉已经删除的 key
+	if bptree, ok := db.index.(*index.BPlusTree); ok {
+		return bptree.RebuildBloomFilter()
+	}
+	return nil
+}
+
+// 将待merge的数据文件中的有效数据重写到merge目录中，并生成hint文件，返回回收的字节数
+// 执行失败时会删除未完成的merge目录
+func (db *DB) mergeDataFiles(ctx context.Context, mergeFiles []*data.DataFile, nonMergeFileId uint32) (reclaimed int64, err error) {
 	mergePath := db.getMergePath()
 	// 如果目录存在，说明发生过merge，将其删除掉
-	if _, err := os.Stat(mergePath); err == nil {
-		if err := os.RemoveAll(mergePath); err != nil {
-			return err
+	if _, err := db.fs.Stat(mergePath); err == nil {
+		if err := db.fs.RemoveAll(mergePath); err != nil {
+			return 0, err
 		}
 	}
 	// 创建一个merge path的目录
-	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
-		return err
+	if err := db.fs.MkdirAll(mergePath); err != nil {
+		return 0, err
+	}
+	if err := db.fs.SyncDir(filepath.Dir(mergePath)); err != nil {
+		return 0, err
 	}
 	// 打开一个新的临时bitcask实例
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	mergeOptions.SyncInterval = 0
+	mergeOptions.EventListener = nil
+	// merge 目录中的索引不会被使用，使用内存索引避免在 merge 目录中创建索引文件
+	mergeOptions.IndexType = BTree
+	mergeOptions.IndexerFactory = nil
+	// merge 用于回收空间，不受磁盘配额的限制，剩余空间在开始 merge 之前已经检查过
+	mergeOptions.MaxDiskSize = 0
+	mergeOptions.MinFreeDiskSpace = 0
+	// merge 数据库的写入不持有锁，不能和定时刷新写缓冲的后台任务并发，merge 结束时统一持久化
+	mergeOptions.WriteBufferSize = 0
+	mergeOptions.WriteBufferFlushInterval = 0
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
-		return err
+		_ = db.fs.RemoveAll(mergePath)
+		return 0, err
 	}
+	// merge 目录是新创建的，活跃文件在第一次写入时才会打开
+	mergeDB.directIO = db.options.MergeDirectIO
+	defer func() {
+		if closeErr := mergeDB.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		// merge 失败，删除不完整的merge目录，下次启动时不会加载
+		if err != nil {
+			_ = db.fs.RemoveAll(mergePath)
+		}
+	}()
 
 	// 打开hint文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(db.fs, mergePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
 	// 遍历处理每个数据文件
+	var mergeFilesSize int64
 	for _, dataFile := range mergeFiles {
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			// 解析拿到实际的key
-			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
-			// 和内存中的索引位置进行比较，如果有效则重写
-			if logRecordPos != nil &&
-				logRecordPos.Fid == dataFile.FileId &&
-				logRecordPos.Offset == offset {
-				// 有效数据
-				// 清除事务标记
-				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-				pos, err := mergeDB.appendLogRecord(logRecord)
-				if err != nil {
-					return err
-				}
-				// 将当前位置索引写到hint文件中
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
-					return err
-				}
-			}
-			// 增加 offset
-			offset += size
+		fileSize, err := db.mergeDataFile(ctx, dataFile, mergeDB, hintFile)
+		if err != nil {
+			return 0, err
 		}
+		mergeFilesSize += fileSize
 	}
 	// sync 保证持久化
 	if err := hintFile.Sync(); err != nil {
-		return err
+		return 0, err
 	}
 	if err := mergeDB.Sync(); err != nil {
-		return err
+		return 0, err
+	}
+	// 标识 merge 完成之前，merge 目录中的所有文件都需要持久化
+	if err := db.fs.SyncDir(mergePath); err != nil {
+		return 0, err
 	}
 	// 写标识 merge 完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(db.fs, mergePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 	mergeFinRecord := &data.LogRecord{
 		Key:   []byte(mergeFinishedKey),
 		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
 	}
 	encodeLogRecord, _ := data.EncodeLogRecord(mergeFinRecord)
 	if err := mergeFinishedFile.Write(encodeLogRecord); err != nil {
-		return err
+		return 0, err
 	}
 	if err := mergeFinishedFile.Sync(); err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	if err := db.fs.SyncDir(mergePath); err != nil {
+		return 0, err
+	}
+	return mergeFilesSize - int64(atomic.LoadUint64(&mergeDB.metrics.bytesWritten)), nil
+}
+
+// 将一个数据文件中的有效数据重写到merge实例中，并将新的位置写到hint文件中，返回数据文件的大小
+func (db *DB) mergeDataFile(ctx context.Context, dataFile *data.DataFile, mergeDB *DB, hintFile *data.DataFile) (int64, error) {
+	// 使用单独打开的 Direct IO 文件读取，不影响正常读取使用的文件
+	if db.options.MergeDirectIO {
+		directFile, err := data.OpenDataFile(db.fs, db.options.DirPath, dataFile.FileId, fio.DirectIO)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			_ = directFile.Close()
+		}()
+		dataFile = directFile
+	} else {
+		// 文件可能因为打开文件数量的限制被关闭，读取期间不会被淘汰
+		release, err := db.acquireDataFile(dataFile)
+		if err != nil {
+			return 0, err
+		}
+		defer release()
+	}
+
+	fileSize, err := dataFile.IOManager.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64 = 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		// 解析拿到实际的key
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		db.mu.RLock()
+		logRecordPos := db.index.Get(realKey)
+		db.mu.RUnlock()
+		// 和内存中的索引位置进行比较，如果有效则重写
+		if logRecordPos != nil &&
+			logRecordPos.Fid == dataFile.FileId &&
+			logRecordPos.Offset == offset {
+			// 有效数据
+			// 清除事务标记
+			logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+			pos, err := mergeDB.appendLogRecord(logRecord)
+			if err != nil {
+				return 0, err
+			}
+			// 将当前位置索引写到hint文件中
+			if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
+				return 0, err
+			}
+		}
+		// 增加 offset
+		offset += size
+	}
+	return fileSize, nil
 }
 
 func (db *DB) getMergePath() string {
@@ -170,27 +333,32 @@ func (db *DB) getMergePath() string {
 	return filepath.Join(dir, base+mergeDirName)
 }
 
-func (db *DB) loadMergeFiles() error {
+// 将完成的 merge 目录中的文件移动到数据目录中，返回是否安装了 merge 的结果
+// 安装之后数据的位置发生了变化，持久化的索引需要重建
+func (db *DB) loadMergeFiles() (bool, error) {
 	mergePath := db.getMergePath()
 	// merge目录不存在则直接返回
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
-		return nil
+	if _, err := db.fs.Stat(mergePath); os.IsNotExist(err) {
+		return false, nil
 	}
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
 
-	dirEntries, err := os.ReadDir(mergePath)
+	dirEntries, err := db.fs.ReadDir(mergePath)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// 查找标识merge完成的文件,判断merge是否处理完了
-	var mergeFinished bool
+	var mergeFinished, installing bool
 	var mergeFileNames []string
 	for _, entry := range dirEntries {
 		if entry.Name() == data.MergeFinishedFileName {
+			// 标识 merge 完成的文件最后移动
 			mergeFinished = true
+			continue
+		}
+		if entry.Name() == mergeInstallingFileName {
+			installing = true
+			continue
 		}
 		if entry.Name() == data.SeqNoFileName {
 			// 跳过
@@ -199,45 +367,116 @@ func (db *DB) loadMergeFiles() error {
 		if entry.Name() == fileLockName {
 			continue
 		}
+		// MANIFEST 只描述 merge 目录自身，不能覆盖数据目录的 MANIFEST
+		if entry.Name() == data.ManifestFileName || entry.Name() == data.ManifestTempFileName {
+			continue
+		}
+		// merge 目录中的B+树索引只包含参与 merge 的数据
+		if entry.Name() == index.BPTreeIndexFileName {
+			continue
+		}
 		mergeFileNames = append(mergeFileNames, entry.Name())
 	}
+	// 标识 merge 完成的文件在写入时崩溃，没有完整写入，同样说明 merge 没有完成
+	var nonMergeFileId uint32
+	if mergeFinished {
+		nonMergeFileId, err = db.getNonMergeFileId(mergePath)
+		if err != nil {
+			// 开始移动之前标识文件已经持久化，之后读取失败不能丢弃 merge 目录
+			if installing {
+				return false, err
+			}
+			mergeFinished = false
+		}
+	}
 	// 没有merge完成，则直接返回
+	// 标识文件已经移动到数据目录中，说明上次启动时已经移动完成，只是没有删除 merge 目录
 	if !mergeFinished {
-		return nil
-	}
-
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
-	if err != nil {
-		return nil
+		if !installing {
+			db.listener.OnRecovery(RecoveryInfo{Action: RecoveryMergeDiscarded})
+		}
+		_ = db.fs.RemoveAll(mergePath)
+		// 上次移动完成之后没有正常启动，持久化的索引可能还没有重建
+		return installing, nil
 	}
+	start := time.Now()
 
-	// 删除旧的数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(db.options.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
-				return err
+	// 上次启动时移动到一半崩溃，旧的数据文件已经删除，数据目录中 nonMergeFileId 之前的文件是已经移动的新文件
+	var fileIds []uint32
+	if !installing {
+		// 删除旧的数据文件
+		var fileId uint32 = 0
+		for ; fileId < nonMergeFileId; fileId++ {
+			fileName := data.GetDataFileName(db.options.DirPath, fileId)
+			if _, err := db.fs.Stat(fileName); err == nil {
+				if err := db.fs.Remove(fileName); err != nil {
+					return false, err
+				}
+				fileIds = append(fileIds, fileId)
 			}
 		}
+
+		// 磁盘上的B+树索引仍然指向被删除的旧数据文件，删除之后在创建索引时重建
+		bptreeFileName := filepath.Join(db.options.DirPath, index.BPTreeIndexFileName)
+		if err := db.fs.Remove(bptreeFileName); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if err := db.fs.SyncDir(db.options.DirPath); err != nil {
+			return false, err
+		}
+
+		// 旧的数据文件删除完成之后才能开始移动，崩溃之后不会再删除已经移动的新文件
+		installingFile, err := db.fs.OpenFile(filepath.Join(mergePath, mergeInstallingFileName), fio.StandardFIO)
+		if err != nil {
+			return false, err
+		}
+		if err := installingFile.Close(); err != nil {
+			return false, err
+		}
+		if err := db.fs.SyncDir(mergePath); err != nil {
+			return false, err
+		}
 	}
 
 	// 将新的数据文件移动到数据目录中
 	for _, fileName := range mergeFileNames {
 		srcPath := filepath.Join(mergePath, fileName)
 		destPath := filepath.Join(db.options.DirPath, fileName)
-		if err := os.Rename(srcPath, destPath); err != nil {
-			return err
+		if err := db.fs.Rename(srcPath, destPath); err != nil {
+			return false, err
 		}
 	}
-	return nil
+	// 其他文件都移动完成并持久化之后，最后移动标识 merge 完成的文件
+	if err := db.fs.SyncDir(db.options.DirPath); err != nil {
+		return false, err
+	}
+	if err := db.fs.SyncDir(mergePath); err != nil {
+		return false, err
+	}
+	srcPath := filepath.Join(mergePath, data.MergeFinishedFileName)
+	destPath := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if err := db.fs.Rename(srcPath, destPath); err != nil {
+		return false, err
+	}
+	if err := db.fs.SyncDir(db.options.DirPath); err != nil {
+		return false, err
+	}
+	db.listener.OnRecovery(RecoveryInfo{
+		Action:   RecoveryMergeInstalled,
+		FileIds:  fileIds,
+		Records:  len(mergeFileNames) + 1,
+		Duration: time.Since(start),
+	})
+	_ = db.fs.RemoveAll(mergePath)
+	return true, nil
 }
 
 func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(db.fs, dirPath)
 	if err != nil {
 		return 0, err
 	}
+	defer mergeFinishedFile.Close()
 	record, _, err := mergeFinishedFile.ReadLogRecord(0)
 	if err != nil {
 		return 0, err
@@ -252,18 +491,22 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 func (db *DB) loadIndexFromHintFile() error {
 	// 查看hint索引文件是否存在
 	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
-	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+	if _, err := db.fs.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
 
 	// 打开hint索引文件
-	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	hintFile, err := data.OpenHintFile(db.fs, db.options.DirPath)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 
 	// 读取文件中的索引
+	start := time.Now()
+	var records int
 	var offset int64 = 0
+	loader := db.newIndexLoader()
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
 		if err != nil {
@@ -275,8 +518,15 @@ func (db *DB) loadIndexFromHintFile() error {
 
 		// 解码拿到实际的位置索引
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		loader.add(logRecord.Key, false, pos)
 		offset += size
+		records++
 	}
+	loader.flush()
+	db.listener.OnRecovery(RecoveryInfo{
+		Action:   RecoveryHintLoaded,
+		Records:  records,
+		Duration: time.Since(start),
+	})
 	return nil
 }
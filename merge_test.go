@@ -1,11 +1,15 @@
 package bitcask_go
 
 import (
+	"bitcask-go/fio"
 	"bitcask-go/utils"
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestDB_Merge(t *testing.T) {
@@ -198,3 +202,141 @@ func TestDB_Merge5(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+// Merge 过程中被取消
+func TestDB_MergeContext(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-ctx")
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.MergeContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	// 已经开始的 merge 被取消，不会留下merge目录
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	go cancel2()
+	err = db.MergeContext(ctx2)
+	if err != nil {
+		assert.Equal(t, context.Canceled, err)
+		_, err = os.Stat(db.getMergePath())
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.False(t, db.isMerging)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	keys := db2.ListKeys()
+	assert.Equal(t, 50000, len(keys))
+}
+
+func TestDB_MergeDirectIO(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-direct-io")
+	opts.DataFileSize = 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.MergeDirectIO = true
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(512))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	err = db.Merge()
+	if errors.Is(err, fio.ErrDirectIOUnsupported) {
+		t.Skip(err)
+	}
+	assert.Nil(t, err)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, 5000, len(db2.ListKeys()))
+	for i := 5000; i < 10000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+// 开启写缓冲时 merge，merge 数据库不会启动定时刷新写缓冲的后台任务
+func TestDB_MergeWriteBuffer(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-write-buffer")
+	opts.DataFileSize = 256 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.WriteBufferSize = 32 * 1024
+	opts.WriteBufferFlushInterval = time.Millisecond
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 10000; i < 11000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+	}()
+	err = db.Merge()
+	assert.Nil(t, err)
+	wg.Wait()
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, 6000, len(db2.ListKeys()))
+	for i := 5000; i < 11000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
@@ -0,0 +1,215 @@
+package bitcask_go
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const metricsNamespace = "bitcask"
+
+var (
+	// 读写、持久化等操作的延迟分桶边界，单位为秒
+	latencyBuckets = []float64{
+		0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+		0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+	}
+	// merge 耗时的分桶边界，单位为秒
+	mergeDurationBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800}
+)
+
+// Metrics 存储引擎运行指标的快照
+type Metrics struct {
+	Puts                uint64            // 成功的 Put 操作次数（包含批量写中的Put）
+	Gets                uint64            // Get 操作次数
+	GetMisses           uint64            // Get 未找到 key 的次数
+	Deletes             uint64            // 成功的 Delete 操作次数（包含批量写中的Delete）
+	BytesWritten        uint64            // 累计写入数据文件的字节数
+	Syncs               uint64            // 活跃文件的 fsync 次数
+	FileRotations       uint64            // 活跃文件写满后切换新文件的次数
+	Merges              uint64            // 成功完成的 merge 次数
+	MergeReclaimedBytes uint64            // merge 累计回收的字节数
+	IndexKeys           uint64            // 内存索引中 key 的数量
+	IndexMemory         int64             // 索引占用内存的估算值
+	DataFiles           uint64            // 数据文件的数量
+	ReclaimableSize     int64             // 可以进行merge回收的数据量
+	PutLatency          HistogramSnapshot // Put 延迟分布
+	GetLatency          HistogramSnapshot // Get 延迟分布
+	DeleteLatency       HistogramSnapshot // Delete 延迟分布
+	SyncLatency         HistogramSnapshot // fsync 延迟分布
+	MergeDuration       HistogramSnapshot // merge 耗时分布
+}
+
+// HistogramSnapshot 直方图快照，桶的计数是累积的，与 Prometheus 语义一致
+type HistogramSnapshot struct {
+	Buckets []float64 // 每个桶的上边界，单位为秒
+	Counts  []uint64  // 小于等于对应上边界的观测次数
+	Count   uint64    // 总观测次数
+	Sum     float64   // 所有观测值之和，单位为秒
+}
+
+// histogram 无锁的固定分桶直方图
+type histogram struct {
+	bounds []float64
+	counts []uint64 // 每个桶自身的计数，最后一个为 +Inf 桶
+	count  uint64
+	sum    uint64 // 纳秒
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	idx := len(h.bounds)
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			idx = i
+			break
+		}
+	}
+	atomic.AddUint64(&h.counts[idx], 1)
+	atomic.AddUint64(&h.sum, uint64(d.Nanoseconds()))
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Buckets: append([]float64(nil), h.bounds...),
+		Counts:  make([]uint64, len(h.bounds)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadUint64(&h.sum)).Seconds(),
+	}
+	var cumulative uint64
+	for i := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		snap.Counts[i] = cumulative
+	}
+	return snap
+}
+
+// metrics 存储引擎内部统计的运行指标，所有字段都通过原子操作更新
+type metrics struct {
+	puts                uint64
+	gets                uint64
+	getMisses           uint64
+	deletes             uint64
+	bytesWritten        uint64
+	syncs               uint64
+	fileRotations       uint64
+	merges              uint64
+	mergeReclaimedBytes uint64
+	putLatency          *histogram
+	getLatency          *histogram
+	deleteLatency       *histogram
+	syncLatency         *histogram
+	mergeDuration       *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		putLatency:    newHistogram(latencyBuckets),
+		getLatency:    newHistogram(latencyBuckets),
+		deleteLatency: newHistogram(latencyBuckets),
+		syncLatency:   newHistogram(latencyBuckets),
+		mergeDuration: newHistogram(mergeDurationBuckets),
+	}
+}
+
+// Metrics 返回存储引擎当前运行指标的快照
+func (db *DB) Metrics() *Metrics {
+	db.mu.RLock()
+	var dataFiles = uint64(len(db.olderFiles))
+	if db.activeFile != nil {
+		dataFiles += 1
+	}
+	reclaimSize := db.reclaimSize
+	indexKeys := uint64(db.index.Size())
+	indexMemory := db.index.MemoryUsage()
+	db.mu.RUnlock()
+
+	m := db.metrics
+	return &Metrics{
+		Puts:                atomic.LoadUint64(&m.puts),
+		Gets:                atomic.LoadUint64(&m.gets),
+		GetMisses:           atomic.LoadUint64(&m.getMisses),
+		Deletes:             atomic.LoadUint64(&m.deletes),
+		BytesWritten:        atomic.LoadUint64(&m.bytesWritten),
+		Syncs:               atomic.LoadUint64(&m.syncs),
+		FileRotations:       atomic.LoadUint64(&m.fileRotations),
+		Merges:              atomic.LoadUint64(&m.merges),
+		MergeReclaimedBytes: atomic.LoadUint64(&m.mergeReclaimedBytes),
+		IndexKeys:           indexKeys,
+		IndexMemory:         indexMemory,
+		DataFiles:           dataFiles,
+		ReclaimableSize:     reclaimSize,
+		PutLatency:          m.putLatency.snapshot(),
+		GetLatency:          m.getLatency.snapshot(),
+		DeleteLatency:       m.deleteLatency.snapshot(),
+		SyncLatency:         m.syncLatency.snapshot(),
+		MergeDuration:       m.mergeDuration.snapshot(),
+	}
+}
+
+// WritePrometheus 以 Prometheus 文本格式输出运行指标
+func (db *DB) WritePrometheus(w io.Writer) error {
+	return db.Metrics().WritePrometheus(w)
+}
+
+// WritePrometheus 以 Prometheus 文本格式（text exposition format）输出指标快照
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	writeCounter(bw, "puts_total", "Total number of put operations.", m.Puts)
+	writeCounter(bw, "gets_total", "Total number of get operations.", m.Gets)
+	writeCounter(bw, "get_misses_total", "Total number of get operations that found no key.", m.GetMisses)
+	writeCounter(bw, "deletes_total", "Total number of delete operations.", m.Deletes)
+	writeCounter(bw, "bytes_written_total", "Total bytes appended to data files.", m.BytesWritten)
+	writeCounter(bw, "syncs_total", "Total number of fsync calls on the active data file.", m.Syncs)
+	writeCounter(bw, "file_rotations_total", "Total number of active data file rotations.", m.FileRotations)
+	writeCounter(bw, "merges_total", "Total number of completed merges.", m.Merges)
+	writeCounter(bw, "merge_reclaimed_bytes_total", "Total bytes reclaimed by merges.", m.MergeReclaimedBytes)
+	writeGauge(bw, "index_keys", "Number of keys in the index.", float64(m.IndexKeys))
+	writeGauge(bw, "data_files", "Number of data files.", float64(m.DataFiles))
+	writeGauge(bw, "index_memory_bytes", "Estimated memory used by the index.", float64(m.IndexMemory))
+	writeGauge(bw, "reclaimable_bytes", "Bytes that can be reclaimed by a merge.", float64(m.ReclaimableSize))
+	writeHistogram(bw, "put_duration_seconds", "Latency of put operations.", m.PutLatency)
+	writeHistogram(bw, "get_duration_seconds", "Latency of get operations.", m.GetLatency)
+	writeHistogram(bw, "delete_duration_seconds", "Latency of delete operations.", m.DeleteLatency)
+	writeHistogram(bw, "sync_duration_seconds", "Latency of fsync calls on the active data file.", m.SyncLatency)
+	writeHistogram(bw, "merge_duration_seconds", "Duration of completed merges.", m.MergeDuration)
+
+	return bw.Flush()
+}
+
+func writeCounter(w *bufio.Writer, name, help string, value uint64) {
+	name = metricsNamespace + "_" + name
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func writeGauge(w *bufio.Writer, name, help string, value float64) {
+	name = metricsNamespace + "_" + name
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func writeHistogram(w *bufio.Writer, name, help string, h HistogramSnapshot) {
+	name = metricsNamespace + "_" + name
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.Buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.Counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.Sum))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,127 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram_Observe(t *testing.T) {
+	h := newHistogram([]float64{0.001, 0.01, 0.1})
+	h.observe(500 * time.Microsecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(time.Second)
+
+	snap := h.snapshot()
+	assert.Equal(t, uint64(3), snap.Count)
+	assert.Equal(t, []uint64{1, 2, 2}, snap.Counts)
+	assert.InDelta(t, 1.0055, snap.Sum, 1e-9)
+
+	// 修改快照不会影响直方图的桶边界
+	snap.Buckets[0] = 1
+	assert.Equal(t, []float64{0.001, 0.01, 0.1}, h.snapshot().Buckets)
+}
+
+func TestDB_Metrics(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-metrics")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("unknown key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	m := db.Metrics()
+	assert.Equal(t, uint64(100), m.Puts)
+	assert.Equal(t, uint64(2), m.Gets)
+	assert.Equal(t, uint64(1), m.GetMisses)
+	assert.Equal(t, uint64(1), m.Deletes)
+	assert.Equal(t, uint64(99), m.IndexKeys)
+	assert.True(t, m.BytesWritten > 100*1024)
+	assert.True(t, m.FileRotations > 0)
+	assert.Equal(t, m.FileRotations+1, m.DataFiles)
+	assert.Equal(t, m.Syncs, m.SyncLatency.Count)
+	assert.Equal(t, uint64(100), m.PutLatency.Count)
+
+	var buf bytes.Buffer
+	err = db.WritePrometheus(&buf)
+	assert.Nil(t, err)
+	text := buf.String()
+	assert.True(t, strings.Contains(text, "# TYPE bitcask_puts_total counter\nbitcask_puts_total 100\n"))
+	assert.True(t, strings.Contains(text, "bitcask_index_keys 99\n"))
+	assert.True(t, strings.Contains(text, "bitcask_put_duration_seconds_bucket{le=\"+Inf\"} 100\n"))
+	assert.True(t, strings.Contains(text, "bitcask_put_duration_seconds_count 100\n"))
+}
+
+func TestDB_Metrics_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-metrics-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	m := db.Metrics()
+	assert.Equal(t, uint64(1), m.Merges)
+	assert.Equal(t, uint64(1), m.MergeDuration.Count)
+	assert.True(t, m.MergeReclaimedBytes > 50*1024)
+}
+
+// 失败的写入和删除不计入操作次数和延迟
+func TestDB_Metrics_FailedWrites(t *testing.T) {
+	ffs := newFaultFileSystem()
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-metrics-failed"
+	opts.FileSystem = ffs
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(128)))
+
+	ffs.inject(faultWriteError, 1)
+	assert.NotNil(t, db.Put(utils.GetTestKey(2), utils.RandomValue(128)))
+	ffs.inject(faultWriteError, 1)
+	assert.NotNil(t, db.Delete(utils.GetTestKey(1)))
+	ffs.inject(faultWriteError, 0)
+
+	m := db.Metrics()
+	assert.Equal(t, uint64(1), m.Puts)
+	assert.Equal(t, uint64(0), m.Deletes)
+	assert.Equal(t, uint64(1), m.PutLatency.Count)
+	assert.Equal(t, uint64(0), m.DeleteLatency.Count)
+}
@@ -1,35 +1,115 @@
 package bitcask_go
 
-import "os"
+import (
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"context"
+	"os"
+	"time"
+)
 
 type Options struct {
 	// 数据目录
 	DirPath string
 
-	// 数据文件的大小
+	// 数据文件的大小，修改之后已有的数据文件保持原来的大小，只影响之后新建的数据文件
 	DataFileSize int64
 
+	// 新的活跃文件是否预分配 DataFileSize 大小的磁盘空间，只在 Linux 上使用标准文件IO时生效
+	// 写入不会再改变文件大小，持久化时不需要更新文件的元数据；文件写满或者关闭时截断未使用的空间
+	// 默认关闭，打开数据库时会立即占用 DataFileSize 大小的磁盘空间，小的数据库和临时的数据库并不需要
+	Preallocate bool
+
 	// 每次写数据是否持久化
 	SyncWrites bool
 
 	// 累计写到多少字节后进行持久化
 	BytesPerSync uint
 
+	// 后台定时持久化活跃文件的间隔，为 0 表示不定时持久化
+	// 写入较少时 BytesPerSync 迟迟达不到，设置之后数据最长在这段时间之后被持久化
+	SyncInterval time.Duration
+
 	// 索引类型
 	IndexType IndexerType
 
+	// 自定义索引的工厂函数，IndexType 为 Custom 时使用
+	// 实现 index.PersistentIndexer 的索引启动时可以跳过数据文件的重放
+	IndexerFactory IndexerFactory
+
+	// 索引类型和数据目录创建时的不一致时，是否按照新的索引类型重新构建索引
+	// 内存索引之间总是可以切换，涉及持久化的索引时为 false 则 Open 返回 ErrIndexTypeMismatch
+	AllowIndexConversion bool
+
+	// 索引内存占用的上限，字节为单位，为 0 表示不限制
+	// 写入新的 key 会超过上限时返回 ErrIndexMemoryExceeded，覆盖已有的 key 和删除不受影响
+	MaxIndexMemory int64
+
+	// 数据目录占用磁盘空间的上限，字节为单位，为 0 表示不限制
+	// 写入会超过上限时返回 ErrDiskQuotaExceeded，删除和 merge 不受影响，可以用来回收空间
+	MaxDiskSize int64
+
+	// 磁盘剩余空间的下限，字节为单位，为 0 表示不检查
+	// 写入之后剩余空间会低于下限时返回 ErrDiskQuotaExceeded，避免磁盘写满时留下不完整的数据
+	MinFreeDiskSpace int64
+
+	// Get 使用的 value 缓存的大小，字节为单位，为 0 表示不使用缓存
+	// 缓存以数据在磁盘上的位置为 key，热点 key 的 Get 不需要再读取数据文件
+	ValueCacheSize int64
+
+	// B+ 树索引布隆过滤器的误判率，不存在的 key 大多数不需要读取磁盘上的索引
+	// 误判率越低占用的内存越多，为 0 表示不使用布隆过滤器
+	BloomFalsePositive float64
+
+	// 同时打开的旧数据文件数量的上限，为 0 表示不限制
+	// 超过上限时关闭最久没有读取的文件，再次读取时重新打开，适合数据文件较多、文件句柄数量受限的场景
+	MaxOpenFiles int
+
 	// 启动时是否使用mmap加载数据
 	MMapAtStartup bool
 
+	// 活跃文件是否使用可写的 mmap 写入，写满之后转为标准文件IO
+	// 进程崩溃时活跃文件尾部可能残留预分配的空间，下次启动时会被截断
+	MMapWrites bool
+
+	// 活跃文件写缓冲区的大小，字节为单位，为 0 表示不使用写缓冲
+	// 写入先暂存在内存中，缓冲区满了、Sync 或者达到 WriteBufferFlushInterval 时才写入文件，
+	// 进程崩溃时会丢失缓冲区中的数据
+	WriteBufferSize int
+
+	// 写缓冲区中的数据最长停留的时间，为 0 表示只在缓冲区满了或者 Sync 时写入文件
+	WriteBufferFlushInterval time.Duration
+
+	// merge 读取旧数据文件和写入新数据文件时是否使用 O_DIRECT，避免大量顺序读写挤占页缓存
+	// 只在 Linux 上支持，文件系统不支持时 merge 返回 fio.ErrDirectIOUnsupported
+	MergeDirectIO bool
+
 	// 数据文件合并的阈值
 	DataFileMergeRatio float32
+
+	// 是否完全在内存中运行，不会访问磁盘，不支持 B+ 树索引
+	// FileSystem 为空时每次 Open 都使用新的内存文件系统，关闭之后数据丢失，
+	// 需要重新打开或者打开备份时，将同一个 fio.NewMemFileSystem() 设置为 FileSystem
+	InMemory bool
+
+	// 数据目录所在的文件系统，为空时使用操作系统的文件系统
+	FileSystem fio.FileSystem
+
+	// 内部事件监听器，为空则不监听
+	EventListener EventListener
 }
 
 type IteratorOptions struct {
 	// 遍历前缀为指定值的key
 	Prefix []byte
-	// 是否反向遍历，默认false是正向
+	// 是否反向遍历，默认false是正向；无序的索引不支持反向遍历
 	Reverse bool
+	// 遍历范围的下界（包含），nil 表示没有下界
+	LowerBound []byte
+	// 遍历范围的上界（不包含），nil 表示没有上界
+	UpperBound []byte
+	// 遍历使用的上下文，被取消之后迭代器变为无效，为空则不会被取消
+	Context context.Context
 }
 
 // WriteBatchOptions 批量写配置项
@@ -52,14 +132,48 @@ const (
 
 	// BPlusTree B+ 树索引，将索引存储到磁盘上
 	BPlusTree
+
+	// Hash 哈希索引，读写性能和内存占用更优，但 key 之间没有顺序
+	// 迭代器的遍历顺序不确定，不支持 Seek 和反向遍历
+	Hash
+
+	// SkipList 并发跳表索引，写入只锁住需要修改的节点，适合并发写入较多的场景
+	SkipList
+
+	// Custom 由 Options.IndexerFactory 创建的自定义索引
+	Custom
 )
 
+// IndexerFactory 创建自定义索引，dirPath 为数据目录，sync 为是否同步写入
+type IndexerFactory func(dirPath string, sync bool) (index.Indexer, error)
+
+// 数据目录使用的文件系统
+func (options Options) fileSystem() fio.FileSystem {
+	if options.FileSystem != nil {
+		return options.FileSystem
+	}
+	if options.InMemory {
+		return fio.NewMemFileSystem()
+	}
+	return fio.OSFileSystem
+}
+
+// 是否使用内存文件系统
+func (options Options) inMemory() bool {
+	if options.FileSystem == nil {
+		return options.InMemory
+	}
+	_, ok := options.FileSystem.(*fio.MemFileSystem)
+	return ok
+}
+
 var DefaultOptions = Options{
 	DirPath:            os.TempDir(),
 	DataFileSize:       256 * 1024 * 1024, // 256M
 	SyncWrites:         false,
 	BytesPerSync:       0,
 	IndexType:          BTree,
+	BloomFalsePositive: 0.01,
 	MMapAtStartup:      true,
 	DataFileMergeRatio: 0.5,
 }
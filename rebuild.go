@@ -0,0 +1,153 @@
+package bitcask_go
+
+import (
+	"bitcask-go/index"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 创建索引，返回索引是否需要从 hint 文件和数据文件中重建
+// 内存索引总是需要从文件中加载；B+树索引文件不存在、损坏或者需要转换索引类型时需要重建；
+// 自定义索引由 PersistentIndexer 决定，转换索引类型或者安装了 merge 时总是重建
+// stale 为 true 表示磁盘上的索引已经失效，例如转换了索引类型或者安装了 merge
+// 需要重建的B+树索引写在临时文件中，加载完成之后调用 installRebuiltIndex 替换索引文件
+func (db *DB) openIndex(stale bool) (bool, error) {
+	if db.options.IndexType == BPlusTree {
+		bptree, err := db.openBPTreeIndex(stale)
+		if err != nil {
+			return false, err
+		}
+		if bptree != nil {
+			db.index = bptree
+			return false, nil
+		}
+	}
+
+	indexer, err := db.newIndex()
+	if err != nil {
+		return false, err
+	}
+	db.index = indexer
+	if persistent, ok := indexer.(index.PersistentIndexer); ok && db.options.IndexType == Custom {
+		return stale || !persistent.Persistent(), nil
+	}
+	return true, nil
+}
+
+// 打开磁盘上的B+树索引，索引文件不存在、损坏或者已经失效时删除索引文件并返回 nil
+func (db *DB) openBPTreeIndex(stale bool) (*index.BPlusTree, error) {
+	fileName := filepath.Join(db.options.DirPath, index.BPTreeIndexFileName)
+	if _, err := db.fs.Stat(fileName); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !stale {
+		bptree, err := index.OpenBPlusTreeFile(fileName, db.options.SyncWrites, db.options.BloomFalsePositive)
+		if err == nil {
+			return bptree, nil
+		}
+	}
+	// 从其他类型转换过来、安装了 merge 之后或者文件损坏，残留的索引文件不能再使用
+	// 删除需要持久化，否则重建完成之前崩溃时失效的索引文件会重新出现
+	if err := db.fs.Remove(fileName); err != nil {
+		return nil, err
+	}
+	return nil, db.fs.SyncDir(db.options.DirPath)
+}
+
+// 创建一个空的索引用于从数据文件中加载
+// B+树索引写在临时文件中，加载完成之前崩溃不会留下不完整的索引文件
+func (db *DB) newIndex() (index.Indexer, error) {
+	if db.options.IndexerFactory != nil {
+		return db.options.IndexerFactory(db.options.DirPath, db.options.SyncWrites)
+	}
+	if db.options.IndexType != BPlusTree {
+		return index.NewIndexer(db.options.IndexType, db.options.DirPath,
+			db.options.SyncWrites, db.options.BloomFalsePositive), nil
+	}
+	fileName := filepath.Join(db.options.DirPath, index.BPTreeRebuildFileName)
+	if err := db.fs.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return index.OpenBPlusTreeFile(fileName, db.options.SyncWrites, db.options.BloomFalsePositive)
+}
+
+// 将加载完成的B+树索引从临时文件重命名为正式的索引文件
+func (db *DB) installRebuiltIndex() error {
+	bptree, ok := db.index.(*index.BPlusTree)
+	if !ok || db.options.IndexType != BPlusTree {
+		return nil
+	}
+	if err := bptree.Sync(); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(filepath.Join(db.options.DirPath, index.BPTreeRebuildFileName),
+		filepath.Join(db.options.DirPath, index.BPTreeIndexFileName)); err != nil {
+		return err
+	}
+	return db.fs.SyncDir(db.options.DirPath)
+}
+
+// RebuildIndex 丢弃当前的索引，从 hint 文件和数据文件中重新构建
+// 新的索引构建成功之后才会替换当前的索引，失败时继续使用原来的索引，调用前需要关闭所有的迭代器
+// 自定义索引会重新调用工厂函数，持久化的自定义索引需要由工厂函数自行清空旧的数据
+func (db *DB) RebuildIndex() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	newIndex, err := db.newIndex()
+	if err != nil {
+		return err
+	}
+	oldIndex, oldFileIds, oldReclaimSize := db.index, db.fileIds, db.reclaimSize
+	db.index = newIndex
+
+	// 按照当前打开的数据文件加载索引
+	fileIds := make([]int, 0, len(db.olderFiles)+1)
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, int(fid))
+	}
+	if db.activeFile != nil {
+		fileIds = append(fileIds, int(db.activeFile.FileId))
+	}
+	sort.Ints(fileIds)
+	db.fileIds = fileIds
+	db.reclaimSize = 0
+
+	if err = db.loadIndexFromHintFile(); err == nil {
+		err = db.loadIndexFromDatafiles()
+	}
+	if err != nil {
+		// 恢复原来的索引，丢弃构建了一半的索引
+		if newIndex != oldIndex {
+			_ = newIndex.Close()
+		}
+		if db.options.IndexType == BPlusTree {
+			_ = db.fs.Remove(filepath.Join(db.options.DirPath, index.BPTreeRebuildFileName))
+		}
+		db.index, db.fileIds, db.reclaimSize = oldIndex, oldFileIds, oldReclaimSize
+		return err
+	}
+
+	// 新的索引已经完整，关闭原来的索引之后替换索引文件
+	if newIndex != oldIndex {
+		if err := oldIndex.Close(); err != nil {
+			return err
+		}
+	}
+	if err := db.installRebuiltIndex(); err != nil {
+		return err
+	}
+
+	// 重建的持久化索引中没有事务序列号，重新保存，下一次提交时重新预留
+	if store, ok := db.index.(index.SeqNoStore); ok {
+		if err := store.SaveSeqNo(db.seqNo); err != nil {
+			return err
+		}
+		db.seqNoReserved = db.seqNo
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDB_RebuildIndex_MissingBPTreeIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-rebuild-missing")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 索引文件丢失
+	err = os.Remove(filepath.Join(dir, index.BPTreeIndexFileName))
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 999, db2.index.Size())
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	_, err = db2.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 索引文件损坏
+	err = os.WriteFile(filepath.Join(dir, index.BPTreeIndexFileName), []byte("corrupted index file"), 0644)
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 999, db3.index.Size())
+	val, err = db3.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(999), val)
+}
+
+// 损坏数据文件中间的一个字节，返回恢复原来内容的函数
+func corruptDataFile(t *testing.T, dir string, fileId uint32) func() {
+	fileName := filepath.Join(dir, fmt.Sprintf("%09d", fileId)+data.DataFileNameSuffix)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	corrupted := append([]byte(nil), content...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, corrupted, 0644))
+	return func() {
+		assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	}
+}
+
+// 重建B+树索引的过程中失败（例如进程崩溃），下一次打开时不能使用只加载了一部分的索引文件
+func TestDB_RebuildIndex_InterruptedBPTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-rebuild-interrupted")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 索引文件丢失，重建时读到损坏的数据文件失败
+	assert.Nil(t, os.Remove(filepath.Join(dir, index.BPTreeIndexFileName)))
+	restore := corruptDataFile(t, dir, 0)
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+	_, err = os.Stat(filepath.Join(dir, index.BPTreeIndexFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	// 恢复数据文件之后重新打开，残留的临时索引文件被丢弃
+	restore()
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, db2.index.Size())
+	_, err = os.Stat(filepath.Join(dir, index.BPTreeRebuildFileName))
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 1000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+// 重建索引失败时继续使用原来的索引
+func TestDB_RebuildIndex_Failed(t *testing.T) {
+	for _, indexType := range []IndexerType{BTree, BPlusTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-rebuild-failed")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileSize = 32 * 1024
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}
+		reclaimSize := db.reclaimSize
+
+		restore := corruptDataFile(t, dir, 0)
+		err = db.RebuildIndex()
+		assert.Equal(t, data.ErrInvalidCRC, err)
+		assert.Equal(t, 1000, db.index.Size())
+		assert.Equal(t, reclaimSize, db.reclaimSize)
+		_, err = os.Stat(filepath.Join(dir, index.BPTreeRebuildFileName))
+		assert.True(t, os.IsNotExist(err))
+		val, err := db.Get(utils.GetTestKey(999))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(999), val)
+		assert.Nil(t, db.Put(utils.GetTestKey(1000), utils.GetTestKey(1000)))
+
+		// 恢复数据文件之后可以重建成功
+		restore()
+		assert.Nil(t, db.RebuildIndex())
+		assert.Equal(t, 1001, db.index.Size())
+		val, err = db.Get(utils.GetTestKey(1000))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(1000), val)
+		destroyDB(db)
+	}
+}
+
+func TestDB_RebuildIndex(t *testing.T) {
+	for _, indexType := range []IndexerType{BTree, BPlusTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-rebuild")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileSize = 32 * 1024
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+			assert.Nil(t, err)
+		}
+		for i := 0; i < 100; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		reclaimSize := db.reclaimSize
+
+		err = db.RebuildIndex()
+		assert.Nil(t, err)
+		assert.Equal(t, 900, db.index.Size())
+		assert.Equal(t, reclaimSize, db.reclaimSize)
+		_, err = db.Get(utils.GetTestKey(50))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(utils.GetTestKey(500))
+		assert.Nil(t, err)
+
+		// 重建之后可以继续写入
+		err = db.Put(utils.GetTestKey(50), utils.RandomValue(64))
+		assert.Nil(t, err)
+		assert.Equal(t, 901, len(db.ListKeys()))
+		destroyDB(db)
+	}
+}
+
+// 重建索引的同时并发写入和删除，重建之后的索引包含所有已经返回的写入
+func TestDB_RebuildIndex_Concurrent(t *testing.T) {
+	for _, indexType := range []IndexerType{BTree, BPlusTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-rebuild-concurrent")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileSize = 32 * 1024
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				// 每个协程写入 200 个 key，删除其中的偶数
+				for i := w * 200; i < (w+1)*200; i++ {
+					assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+					if i%2 == 0 {
+						assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+					}
+				}
+			}(w)
+		}
+		for i := 0; i < 5; i++ {
+			assert.Nil(t, db.RebuildIndex())
+		}
+		wg.Wait()
+
+		assert.Equal(t, 400, db.index.Size())
+		reclaimSize := db.reclaimSize
+		assert.Nil(t, db.RebuildIndex())
+		assert.Equal(t, 400, db.index.Size())
+		assert.Equal(t, reclaimSize, db.reclaimSize)
+		for i := 0; i < 800; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i%2 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+		destroyDB(db)
+	}
+}
+
+func TestDB_ConvertIndexType(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-convert-index")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 不允许转换
+	opts.IndexType = BPlusTree
+	_, err = Open(opts)
+	assert.True(t, errors.Is(err, ErrIndexTypeMismatch))
+
+	// BTree 转换为 B+ 树
+	opts.AllowIndexConversion = true
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, db2.index.Size())
+	err = db2.Put(utils.GetTestKey(1000), utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+	m, err := readManifest(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, BPlusTree, m.IndexType)
+
+	// B+ 树转换为 ART
+	opts.IndexType = ART
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, db3.index.Size())
+	val, err := db3.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1000), val)
+	_, err = os.Stat(filepath.Join(dir, index.BPTreeIndexFileName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// merge 之后B+树索引从 merge 后的数据文件中重建，merge 之后写入的数据不会丢失
+func TestDB_Merge_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	for i := 1000; i < 1100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 600, len(db2.ListKeys()))
+	for i := 500; i < 1100; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
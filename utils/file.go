@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"context"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -8,6 +10,9 @@ import (
 	"syscall"
 )
 
+// 拷贝文件时每次读写的块大小
+const copyChunkSize = 1024 * 1024
+
 // DirSize 获取一个目录的大小
 func DirSize(dirPath string) (int64, error) {
 	var size int64
@@ -29,8 +34,13 @@ func AvailableDishSize() (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return DirAvailableSize(wd)
+}
+
+// DirAvailableSize 获取目录所在磁盘剩余可用空间大小
+func DirAvailableSize(dirPath string) (uint64, error) {
 	var stat syscall.Statfs_t
-	if err = syscall.Statfs(wd, &stat); err != nil {
+	if err := syscall.Statfs(dirPath, &stat); err != nil {
 		return 0, err
 	}
 	return stat.Bavail * uint64(stat.Bsize), nil
@@ -38,6 +48,11 @@ func AvailableDishSize() (uint64, error) {
 
 // CopyDir 拷贝数据目录
 func CopyDir(src, dest string, exclude []string) error {
+	return CopyDirContext(context.Background(), src, dest, exclude)
+}
+
+// CopyDirContext 拷贝数据目录，ctx 被取消时停止拷贝并返回 ctx 的错误
+func CopyDirContext(ctx context.Context, src, dest string, exclude []string) error {
 	// 目标目录不存在则创建
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
 		if err := os.MkdirAll(dest, os.ModePerm); err != nil {
@@ -45,6 +60,12 @@ func CopyDir(src, dest string, exclude []string) error {
 		}
 	}
 	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		// "/tmp/a/11.data"获得11.data
 		filename := strings.Replace(path, src, "", 1)
 		if filename == "" {
@@ -65,11 +86,40 @@ func CopyDir(src, dest string, exclude []string) error {
 			return os.MkdirAll(filepath.Join(dest, filename), info.Mode())
 		}
 		// 常规文件
-		// 读取
-		data, err := os.ReadFile(filepath.Join(src, filename))
+		return copyFile(ctx, filepath.Join(src, filename), filepath.Join(dest, filename), info.Mode())
+	})
+}
+
+// 分块拷贝文件，每拷贝一块检查一次 ctx 是否被取消
+func copyFile(ctx context.Context, src, dest string, perm fs.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	buf := make([]byte, copyChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := srcFile.Read(buf)
+		if n > 0 {
+			if _, err := destFile.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		return os.WriteFile(filepath.Join(dest, filename), data, info.Mode())
-	})
+	}
 }
@@ -18,3 +18,17 @@ func TestAvailableDishSize(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, size > 0)
 }
+
+func TestDirAvailableSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-available-size")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	size, err := DirAvailableSize(dir)
+	assert.Nil(t, err)
+	assert.True(t, size > 0)
+
+	// 统计的是指定的目录，而不是当前工作目录
+	_, err = DirAvailableSize(dir + "-not-exist")
+	assert.NotNil(t, err)
+}
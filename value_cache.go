@@ -0,0 +1,113 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// value 缓存的分片数量，减少锁竞争
+	valueCacheShards = 16
+	// 每个缓存项除 value 之外的内存开销估算值
+	valueCacheEntryOverhead = 96
+)
+
+// valueCache 以数据在磁盘上的位置为 key 的分片 LRU 缓存
+// 数据文件只会追加写入，同一个位置的数据不会改变；key 被覆盖或者删除之后索引指向新的位置，
+// 旧位置的缓存不会再被访问，最终被淘汰，因此不需要在写入时主动失效
+type valueCache struct {
+	shards [valueCacheShards]*valueCacheShard
+	hits   uint64
+	misses uint64
+}
+
+type valueCacheShard struct {
+	lock     sync.Mutex
+	capacity int64 // 分片的容量，字节为单位
+	size     int64 // 分片当前缓存的大小
+	items    map[valueCacheKey]*list.Element
+	lru      *list.List // 最近访问的在前面
+}
+
+type valueCacheKey struct {
+	fid    uint32
+	offset int64
+}
+
+type valueCacheEntry struct {
+	key   valueCacheKey
+	value []byte
+}
+
+func newValueCache(capacity int64) *valueCache {
+	c := &valueCache{}
+	for i := range c.shards {
+		c.shards[i] = &valueCacheShard{
+			capacity: capacity / valueCacheShards,
+			items:    make(map[valueCacheKey]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *valueCache) shard(key valueCacheKey) *valueCacheShard {
+	h := (uint64(key.fid)<<32 ^ uint64(key.offset)) * 0x9e3779b97f4a7c15
+	return c.shards[h>>60]
+}
+
+// 查找位置对应的 value，返回的切片不能被修改
+func (c *valueCache) get(pos *data.LogRecordPos) ([]byte, bool) {
+	key := valueCacheKey{fid: pos.Fid, offset: pos.Offset}
+	shard := c.shard(key)
+	shard.lock.Lock()
+	elem, ok := shard.items[key]
+	if ok {
+		shard.lru.MoveToFront(elem)
+	}
+	shard.lock.Unlock()
+
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return elem.Value.(*valueCacheEntry).value, true
+}
+
+// 缓存位置对应的 value，超过分片容量的 value 不缓存
+func (c *valueCache) add(pos *data.LogRecordPos, value []byte) {
+	key := valueCacheKey{fid: pos.Fid, offset: pos.Offset}
+	charge := int64(len(value) + valueCacheEntryOverhead)
+	shard := c.shard(key)
+	if charge > shard.capacity {
+		return
+	}
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if _, ok := shard.items[key]; ok {
+		return
+	}
+	shard.items[key] = shard.lru.PushFront(&valueCacheEntry{key: key, value: value})
+	shard.size += charge
+	// 淘汰最久没有访问的数据
+	for shard.size > shard.capacity {
+		oldest := shard.lru.Back()
+		entry := shard.lru.Remove(oldest).(*valueCacheEntry)
+		delete(shard.items, entry.key)
+		shard.size -= int64(len(entry.value) + valueCacheEntryOverhead)
+	}
+}
+
+// 清空缓存
+func (c *valueCache) clear() {
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		shard.items = make(map[valueCacheKey]*list.Element)
+		shard.lru.Init()
+		shard.size = 0
+		shard.lock.Unlock()
+	}
+}
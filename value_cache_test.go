@@ -0,0 +1,96 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestValueCache_Evict(t *testing.T) {
+	// 每个分片只能放下两条数据
+	c := newValueCache(valueCacheShards * 2 * (10 + valueCacheEntryOverhead))
+	shard := c.shards[0]
+	var positions []*data.LogRecordPos
+	for offset := int64(0); len(positions) < 3; offset++ {
+		pos := &data.LogRecordPos{Fid: 1, Offset: offset}
+		if c.shard(valueCacheKey{fid: pos.Fid, offset: pos.Offset}) == shard {
+			positions = append(positions, pos)
+		}
+	}
+
+	c.add(positions[0], []byte("value-0000"))
+	c.add(positions[1], []byte("value-0001"))
+	// 访问之后 positions[1] 是最久没有访问的
+	_, ok := c.get(positions[0])
+	assert.True(t, ok)
+	c.add(positions[2], []byte("value-0002"))
+
+	_, ok = c.get(positions[1])
+	assert.False(t, ok)
+	value, ok := c.get(positions[2])
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-0002"), value)
+	assert.Equal(t, uint64(2), c.hits)
+	assert.Equal(t, uint64(1), c.misses)
+
+	// 超过分片容量的数据不缓存
+	c.add(&data.LogRecordPos{Fid: 2}, make([]byte, shard.capacity))
+	_, ok = c.get(&data.LogRecordPos{Fid: 2})
+	assert.False(t, ok)
+
+	c.clear()
+	_, ok = c.get(positions[0])
+	assert.False(t, ok)
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-value-cache")
+	opts.DirPath = dir
+	opts.ValueCacheSize = 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	value := utils.RandomValue(128)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), value))
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val1)
+
+	// 修改返回值不影响缓存
+	val1[0] = 'x'
+	val2, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val2)
+	stat := db.Stat()
+	assert.Equal(t, uint64(1), stat.CacheHits)
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+
+	// 覆盖之后索引指向新的位置，读取到的是新的值
+	value2 := utils.RandomValue(128)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), value2))
+	val3, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value2, val3)
+	assert.Equal(t, uint64(2), db.Stat().CacheMisses)
+
+	// 删除之后不能再读取到
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// merge 之后缓存被清空
+	assert.Nil(t, db.Put(utils.GetTestKey(2), value))
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	misses := db.Stat().CacheMisses
+	val4, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val4)
+	assert.Equal(t, misses+1, db.Stat().CacheMisses)
+}